@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -25,16 +26,28 @@ func main() {
 }
 
 func lock(schemaVer *schemaver.SchemaVer, args []string) int {
-	if os.Getenv(schemaver.EnvSkipLock) != "" {
+	skipLock := schemaVer.Inherited()
+	if skipLock {
 		fmt.Println("Skip acquiring exclusive lock.")
-		defer fmt.Println("Skip releasing exclusive lock.")
 	} else {
 		fmt.Println("Acquiring exclusive lock...")
-		defer fmt.Println("Releasing exclusive lock...")
 	}
 
-	schemaVer.ExclusiveLock()
-	defer schemaVer.Unlock()
+	_, err := schemaVer.ExclusiveLockContext(context.Background())
+	if err != nil {
+		log.Println("Failed to acquire exclusive lock:", err)
+		return 1
+	}
+	defer func() {
+		if skipLock {
+			fmt.Println("Skip releasing exclusive lock.")
+		} else {
+			fmt.Println("Releasing exclusive lock...")
+		}
+		if err := schemaVer.UnlockErr(); err != nil {
+			log.Println("Failed to release exclusive lock:", err)
+		}
+	}()
 
 	return run(args)
 }
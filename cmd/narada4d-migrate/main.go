@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/powerman/narada4d/protocol/mysql"
+	"github.com/powerman/narada4d/schemaver"
+	"github.com/powerman/narada4d/schemaver/migrate"
+)
+
+func main() {
+	log.SetFlags(0)
+	dryRun := flag.Bool("dry-run", false, "show migration plan without migrating")
+	singleStatement := flag.Bool("single-statement", false, "require one statement per migration file")
+	backupCmd := flag.String("backup", "", "shell `command` to backup data before migrating, called with version as last arg, must print backup ID")
+	restoreCmd := flag.String("restore", "", "shell `command` to restore data if migration fails, called with backup ID as last arg")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dir [version]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Migrate data schema at $NARADA4D to version (latest by default)")
+		fmt.Fprintln(flag.CommandLine.Output(), "using NNN_name.up.sql and NNN_name.down.sql files in dir.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 || (*backupCmd == "") != (*restoreCmd == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	schemaVer, err := schemaver.New(schemaver.WithLogger(log.Default()))
+	if errors.Is(err, schemaver.ErrUnknownProtocol) {
+		log.Fatalln("Unsupported $NARADA4D: SQL migrations are supported only for mysql:// (and mariadb://)")
+	} else if err != nil {
+		log.Fatalln("Failed to detect data schema version:", err)
+	}
+	db, err := mysql.OpenDB(os.Getenv(schemaver.EnvLocation))
+	if err != nil {
+		log.Fatalln("Failed to connect:", err)
+	}
+
+	var m migrate.Migrations
+	err = m.RegisterSQL(os.DirFS(flag.Arg(0)), db, migrate.SQLOptions{SingleStatement: *singleStatement})
+	if err != nil {
+		log.Fatalln("Failed to load migrations:", err)
+	}
+	to := m.Latest()
+	if flag.NArg() == 2 {
+		to = schemaver.Version(flag.Arg(1))
+	}
+
+	var backup migrate.Backup
+	if *backupCmd != "" {
+		backup = migrate.CommandBackup{
+			BackupCmd:  shellCmd(*backupCmd),
+			RestoreCmd: shellCmd(*restoreCmd),
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, schemaVer, &m, to, backup, *dryRun)
+	stop()
+	_ = schemaVer.Close()
+	_ = db.Close()
+	os.Exit(code)
+}
+
+func run(ctx context.Context, schemaVer *schemaver.SchemaVer, m *migrate.Migrations, to schemaver.Version, backup migrate.Backup, dryRun bool) int {
+	plan, err := m.Plan(ctx, schemaVer, to)
+	if err != nil {
+		log.Println("Failed to plan migration:", err)
+		return 1
+	}
+
+	fmt.Println("Current version:", plan.From)
+	if plan.From.IsDirty() {
+		fmt.Println("Last migration:", note(ctx, schemaVer))
+	}
+	fmt.Println("Target version:", plan.To)
+	if len(plan.Steps) == 0 {
+		fmt.Println("Nothing to do.")
+		return 0
+	}
+	fmt.Println("Steps:")
+	for _, step := range plan.Steps {
+		fmt.Println("   ", step)
+	}
+	if dryRun {
+		return 0
+	}
+
+	fmt.Println("Migrating...")
+	err = m.RunWithBackup(ctx, schemaVer, to, backup)
+	var rolledBackErr *migrate.RolledBackError
+	if errors.As(err, &rolledBackErr) {
+		log.Println("Failed to migrate, restored from backup:", err)
+		return 1
+	} else if err != nil {
+		log.Println("Failed to migrate:", err)
+		return 1
+	}
+	fmt.Println("Done.")
+	return 0
+}
+
+// note returns note about last migration or error.
+func note(ctx context.Context, schemaVer *schemaver.SchemaVer) string {
+	_, err := schemaVer.SharedLockContext(ctx)
+	if err != nil {
+		return err.Error()
+	}
+	defer schemaVer.Unlock()
+	note, err := schemaVer.Note()
+	if err != nil {
+		return err.Error()
+	}
+	return note
+}
+
+// shellCmd returns args to run cmd using sh with last arg (added by
+// migrate.CommandBackup) appended to cmd as a quoted word.
+func shellCmd(cmd string) []string {
+	return []string{"sh", "-c", cmd + ` "$1"`, "sh"}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver/migrate"
+)
+
+func TestShellCmd(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+
+	b := migrate.CommandBackup{BackupCmd: shellCmd(`printf '%s|%s' "My Backups"`)}
+	id, err := b.Backup(ctx, "1.2")
+	t.Nil(err)
+	t.Equal(id, "My Backups|1.2")
+
+	b = migrate.CommandBackup{BackupCmd: shellCmd(`printf '%s|%s|' a\ b`)}
+	id, err = b.Backup(ctx, "with space")
+	t.Nil(err)
+	t.Equal(id, "a b|with space|")
+}
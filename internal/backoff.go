@@ -13,3 +13,12 @@ func NewBackOff() backoff.BackOff {
 	backOff.MaxElapsedTime = maxElapsedTime
 	return backOff
 }
+
+// NewWaitBackOff returns backoff suitable for waiting without time limit.
+func NewWaitBackOff() backoff.BackOff {
+	const maxInterval = 5 * time.Second
+	backOff := backoff.NewExponentialBackOff()
+	backOff.MaxInterval = maxInterval
+	backOff.MaxElapsedTime = 0
+	return backOff
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+)
+
+var errGoID = errors.New("failed to detect goroutine ID")
+
+// GoID returns ID of current goroutine or error if it can't be parsed
+// from stack trace (its format isn't guaranteed by runtime).
+func GoID() (uint64, error) {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	return parseGoID(buf[:n])
+}
+
+// parseGoID returns ID of goroutine from header of its stack trace
+// ("goroutine 42 [running]:…").
+func parseGoID(stack []byte) (uint64, error) {
+	b := bytes.TrimPrefix(stack, []byte("goroutine "))
+	i := bytes.IndexByte(b, ' ')
+	if len(b) == len(stack) || i <= 0 {
+		return 0, fmt.Errorf("%w: unexpected stack trace %q", errGoID, stack)
+	}
+	id, err := strconv.ParseUint(string(b[:i]), 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("%w: unexpected stack trace %q", errGoID, stack)
+	}
+	return id, nil
+}
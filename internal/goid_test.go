@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestGoID(tt *testing.T) {
+	t := check.T(tt)
+
+	id, err := GoID()
+	t.Nil(err)
+	t.NotZero(id)
+	id2, err := GoID()
+	t.Nil(err)
+	t.Equal(id2, id)
+
+	c := make(chan uint64)
+	go func() {
+		id, err := GoID()
+		t.Nil(err)
+		c <- id
+	}()
+	t.NotEqual(<-c, id)
+}
+
+func TestParseGoID(tt *testing.T) {
+	t := check.T(tt)
+
+	cases := []struct {
+		stack string
+		want  uint64
+	}{
+		{"goroutine 42 [running]:\nmain.main()", 42},
+		{"goroutine 1 [running]:", 1},
+		{"", 0},
+		{"goroutine ", 0},
+		{"goroutine 42", 0},
+		{"goroutine  [running]:", 0},
+		{"goroutine 0 [running]:", 0},
+		{"goroutine x42 [running]:", 0},
+		{"thread 42 [running]:", 0},
+	}
+	for _, v := range cases {
+		id, err := parseGoID([]byte(v.stack))
+		t.Equal(id, v.want, v.stack)
+		t.Equal(errors.Is(err, errGoID), v.want == 0, v.stack)
+	}
+}
@@ -0,0 +1,253 @@
+// Package mysqllock implements locking of Narada4D table shared by
+// mysql and goose-mysql protocols.
+package mysqllock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-sql-driver/mysql"
+	"github.com/powerman/must"
+
+	"github.com/powerman/narada4d/internal"
+	"github.com/powerman/narada4d/schemaver"
+)
+
+const (
+	errLockWaitTimeout = 1205
+
+	sqlExclusivePending = `
+SELECT COUNT(*) FROM performance_schema.metadata_locks
+WHERE OBJECT_TYPE='TABLE' AND OBJECT_SCHEMA=DATABASE() AND OBJECT_NAME='Narada4D'
+  AND LOCK_STATUS='PENDING'
+`
+	sqlSharedLock    = `LOCK TABLES Narada4D READ`
+	sqlExclusiveLock = `LOCK TABLES Narada4D WRITE`
+	sqlUnlock        = `UNLOCK TABLES`
+	sqlSetNoWait     = `SET SESSION lock_wait_timeout=1`
+	sqlResetNoWait   = `SET SESSION lock_wait_timeout=DEFAULT`
+	sqlTokenLock     = `SELECT GET_LOCK(?, 0)`
+	sqlTokenRelease  = `DO RELEASE_LOCK(?)`
+	sqlTokenHeld     = `SELECT IS_USED_LOCK(?) IS NOT NULL`
+	tokenLockPrefix  = "narada4d:"
+)
+
+var errTokenLock = errors.New("failed to acquire token lock")
+
+// Locker implements locking methods of schemaver.Manage (including
+// ManageTry, ManagePending, ManagePing and ManageToken) using LOCK
+// TABLES on Narada4D table.
+type Locker struct {
+	protocol  string
+	opts      schemaver.Options
+	db        *sql.DB
+	conn      *sql.Conn
+	tx        *sql.Tx
+	token     string // Name of user-level lock (without prefix).
+	inherited bool   // Lock is held by parent process (token was verified).
+}
+
+// New creates Locker which uses db to acquire locks. Protocol is used
+// in log messages.
+func New(protocol string, db *sql.DB, opts schemaver.Options) *Locker {
+	return &Locker{protocol: protocol, opts: opts, db: db}
+}
+
+// Tx returns transaction on connection which holds lock or nil if lock
+// isn't held. Narada4D table is accessible only using this transaction.
+func (l *Locker) Tx() *sql.Tx {
+	return l.tx
+}
+
+// Inherited returns true if VerifyToken has succeeded, i.e. lock is
+// held by parent process.
+func (l *Locker) Inherited() bool {
+	return l.inherited
+}
+
+func (l *Locker) SharedLock() {
+	must.PanicIf(l.SharedLockContext(context.Background()))
+}
+
+func (l *Locker) ExclusiveLock() {
+	must.PanicIf(l.ExclusiveLockContext(context.Background()))
+}
+
+func (l *Locker) SharedLockContext(ctx context.Context) error {
+	return l.lock(ctx, sqlSharedLock)
+}
+
+func (l *Locker) ExclusiveLockContext(ctx context.Context) error {
+	return l.lock(ctx, sqlExclusiveLock)
+}
+
+func (l *Locker) lock(ctx context.Context, sqlLock string) error {
+	if l.tx != nil {
+		return schemaver.ErrLocked
+	}
+	op := func() (err error) {
+		err = l.begin(ctx)
+		if err == nil {
+			_, err = l.tx.ExecContext(ctx, sqlLock)
+			if err != nil {
+				l.end()
+			}
+		}
+		if errors.As(err, new(*mysql.MySQLError)) { // Retry on network errors.
+			err = backoff.Permanent(err)
+		}
+		return err
+	}
+	return backoff.RetryNotify(op, backoff.WithContext(l.opts.NewBackOff(), ctx), l.notify)
+}
+
+func (l *Locker) notify(err error, d time.Duration) {
+	l.opts.Logf("narada4d: %s: %v, retry in %v", l.protocol, err, d)
+}
+
+func (l *Locker) TrySharedLock() error {
+	return l.tryLock(sqlSharedLock)
+}
+
+func (l *Locker) TryExclusiveLock() error {
+	return l.tryLock(sqlExclusiveLock)
+}
+
+// tryLock uses minimal lock_wait_timeout supported by MySQL, so it may
+// wait for lock up to 1 second.
+func (l *Locker) tryLock(sqlLock string) error {
+	if l.tx != nil {
+		return schemaver.ErrLocked
+	}
+	err := l.begin(context.Background())
+	if err != nil {
+		return err
+	}
+	_, err = l.tx.Exec(sqlSetNoWait)
+	if err == nil {
+		_, err = l.tx.Exec(sqlLock)
+		if _, errReset := l.tx.Exec(sqlResetNoWait); err == nil && errReset != nil {
+			_ = l.UnlockErr()
+			return errReset
+		}
+	}
+	if err != nil {
+		l.end()
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == errLockWaitTimeout {
+		err = schemaver.ErrWouldBlock
+	}
+	return err
+}
+
+// begin pins connection until end and starts transaction on it.
+// Transaction won't be affected by ctx.Done.
+func (l *Locker) begin(ctx context.Context) (err error) {
+	l.conn, err = l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	l.tx, err = l.conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+	return err
+}
+
+// end rollbacks transaction (if it wasn't committed) and releases
+// connection pinned by begin.
+func (l *Locker) end() {
+	_ = l.tx.Rollback()
+	if l.token != "" { // User-level lock isn't released by transaction.
+		_, err := l.conn.ExecContext(context.Background(), sqlTokenRelease, tokenLockPrefix+l.token)
+		if err != nil { // Connection with lock must not be returned to pool.
+			_ = l.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}
+	_ = l.conn.Close()
+	l.tx, l.conn, l.token = nil, nil, ""
+}
+
+func (l *Locker) Unlock() {
+	must.PanicIf(l.UnlockErr())
+}
+
+func (l *Locker) UnlockErr() error {
+	if l.tx == nil {
+		return schemaver.ErrNotLocked
+	}
+	_, err := l.tx.Exec(sqlUnlock)
+	if err == nil {
+		err = l.tx.Commit()
+	}
+	l.end()
+	if err != nil && !errors.As(err, new(*mysql.MySQLError)) { // Ignore network errors.
+		err = nil
+	}
+	return err
+}
+
+// ExclusivePending implements schemaver.ManagePending. Shared locks
+// never wait for each other, so any pending lock on Narada4D table means
+// someone waits for exclusive lock. It requires enabled
+// performance_schema with "wait/lock/metadata/sql/mdl" instrument.
+func (l *Locker) ExclusivePending() (bool, error) {
+	var count int
+	err := l.db.QueryRow(sqlExclusivePending).Scan(&count)
+	return count > 0, err
+}
+
+// Ping implements schemaver.ManagePing. Lock is released by database
+// when connection used to acquire it is closed.
+func (l *Locker) Ping(ctx context.Context) error {
+	if l.conn == nil {
+		return schemaver.ErrNotLocked
+	}
+	return l.conn.PingContext(ctx)
+}
+
+// Token implements schemaver.ManageToken. Token is a random name of
+// user-level lock acquired (using GET_LOCK) by connection which holds
+// exclusive lock, it's released on unlock.
+func (l *Locker) Token() (string, error) {
+	if l.tx == nil {
+		return "", schemaver.ErrNotLocked
+	}
+	if l.token == "" {
+		token, err := internal.NewToken()
+		if err != nil {
+			return "", err
+		}
+		var acquired sql.NullInt64
+		err = l.tx.QueryRow(sqlTokenLock, tokenLockPrefix+token).Scan(&acquired)
+		if err != nil {
+			return "", err
+		} else if acquired.Int64 != 1 {
+			return "", errTokenLock
+		}
+		l.token = token
+	}
+	return l.token, nil
+}
+
+// VerifyToken implements schemaver.ManageToken. Token is valid while
+// user-level lock with this name is held by any connection.
+func (l *Locker) VerifyToken(token string) error {
+	if _, ok := internal.ParseToken(token); !ok {
+		return fmt.Errorf("%w: %q", schemaver.ErrInvalidToken, token)
+	}
+	var held bool
+	err := l.db.QueryRow(sqlTokenHeld, tokenLockPrefix+token).Scan(&held)
+	if err == nil && !held {
+		err = fmt.Errorf("%w: lock is not held", schemaver.ErrInvalidToken)
+	}
+	l.inherited = err == nil
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -16,6 +17,18 @@ type Ctx = context.Context
 
 var errTCPPortOpen = errors.New("tcp port is open")
 
+// HostWithPort returns host (which may contain port) with defaultPort
+// added if it has no port. Empty host is returned as is.
+func HostWithPort(host, defaultPort string) string {
+	if host == "" {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
 // WaitTCPPort tries to connect to addr until success or ctx.Done.
 func WaitTCPPort(ctx Ctx, addr fmt.Stringer) error {
 	const delay = time.Second / 20
@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+const tokenSize = 16
+
+// NewToken returns random token (32 hex digits).
+func NewToken() (string, error) {
+	buf := make([]byte, tokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ParseToken returns token value or false if s isn't a result of
+// NewToken.
+func ParseToken(s string) ([]byte, bool) {
+	buf, err := hex.DecodeString(s)
+	return buf, err == nil && len(buf) == tokenSize
+}
@@ -0,0 +1,13 @@
+module github.com/powerman/narada4d/observer/otel
+
+go 1.16
+
+require (
+	github.com/powerman/check v1.4.0
+	github.com/powerman/narada4d v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+)
+
+replace github.com/powerman/narada4d => ../..
@@ -0,0 +1,94 @@
+// Package otel provides schemaver.Observer which creates OpenTelemetry
+// spans.
+//
+// It's a separate module to not add OpenTelemetry dependencies to users
+// of narada4d who don't need it.
+package otel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+const instrumentationName = "github.com/powerman/narada4d"
+
+// Attribute keys.
+const (
+	LockTypeKey = attribute.Key("narada4d.lock.type")
+	VersionKey  = attribute.Key("narada4d.version")
+	OpKey       = attribute.Key("narada4d.op")
+)
+
+// Observer implements schemaver.Observer.
+//
+// It creates spans (as children of span in ctx used to acquire lock):
+//
+//   - narada4d.LockWait: waiting for a lock
+//   - narada4d.LockHeld: holding a lock
+//   - narada4d.Get: getting version
+//   - narada4d.Set: setting version
+//
+// Errors are recorded in spans, backend errors are also recorded in
+// span in ctx.
+type Observer struct {
+	tracer trace.Tracer
+}
+
+var _ schemaver.Observer = (*Observer)(nil)
+
+// New creates Observer using given tracer provider or global one if
+// tp is nil.
+func New(tp trace.TracerProvider) *Observer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Observer{tracer: tp.Tracer(instrumentationName)}
+}
+
+func (o *Observer) span(ctx context.Context, name string, d time.Duration, err error, attrs ...attribute.KeyValue) {
+	end := time.Now()
+	_, span := o.tracer.Start(ctx, name,
+		trace.WithTimestamp(end.Add(-d)),
+		trace.WithAttributes(attrs...),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// LockRequested implements schemaver.Observer.
+func (o *Observer) LockRequested(context.Context, schemaver.LockType) {}
+
+// LockAcquired implements schemaver.Observer.
+func (o *Observer) LockAcquired(ctx context.Context, typ schemaver.LockType, wait time.Duration, err error) {
+	o.span(ctx, "narada4d.LockWait", wait, err, LockTypeKey.String(typ.String()))
+}
+
+// LockReleased implements schemaver.Observer.
+func (o *Observer) LockReleased(ctx context.Context, typ schemaver.LockType, held time.Duration, err error) {
+	o.span(ctx, "narada4d.LockHeld", held, err, LockTypeKey.String(typ.String()))
+}
+
+// Get implements schemaver.Observer.
+func (o *Observer) Get(ctx context.Context, ver schemaver.Version, d time.Duration, err error) {
+	o.span(ctx, "narada4d.Get", d, err, VersionKey.String(ver.String()))
+}
+
+// Set implements schemaver.Observer.
+func (o *Observer) Set(ctx context.Context, ver schemaver.Version, d time.Duration, err error) {
+	o.span(ctx, "narada4d.Set", d, err, VersionKey.String(ver.String()))
+}
+
+// BackendError implements schemaver.Observer.
+func (o *Observer) BackendError(ctx context.Context, op string, err error) {
+	trace.SpanFromContext(ctx).RecordError(err, trace.WithAttributes(OpKey.String(op)))
+}
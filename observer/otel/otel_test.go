@@ -0,0 +1,51 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+func TestObserver(tt *testing.T) {
+	t := check.T(tt)
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	o := New(tp)
+	errSome := errors.New("some error")
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	o.LockRequested(ctx, schemaver.LockExclusive)
+	o.LockAcquired(ctx, schemaver.LockExclusive, time.Second, nil)
+	o.Get(ctx, "42", time.Millisecond, nil)
+	o.Set(ctx, "43", time.Millisecond, errSome)
+	o.BackendError(ctx, "Set", errSome)
+	o.LockReleased(ctx, schemaver.LockExclusive, 2*time.Second, nil)
+	parent.End()
+
+	spans := sr.Ended()
+	t.Len(spans, 5)
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	t.DeepEqual(names, []string{"narada4d.LockWait", "narada4d.Get", "narada4d.Set", "narada4d.LockHeld", "parent"})
+	for _, span := range spans[:4] {
+		t.Equal(span.Parent().SpanID(), parent.SpanContext().SpanID())
+	}
+	t.Equal(spans[0].EndTime().Sub(spans[0].StartTime()), time.Second)
+	t.DeepEqual(spans[0].Attributes(), []attribute.KeyValue{LockTypeKey.String("exclusive")})
+	t.Equal(spans[2].Status().Code, codes.Error)
+	t.Len(spans[2].Events(), 1)
+	t.Equal(spans[3].EndTime().Sub(spans[3].StartTime()), 2*time.Second)
+	t.Len(spans[4].Events(), 1)
+}
@@ -0,0 +1,11 @@
+module github.com/powerman/narada4d/observer/prometheus
+
+go 1.16
+
+require (
+	github.com/powerman/check v1.4.0
+	github.com/powerman/narada4d v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.11.1
+)
+
+replace github.com/powerman/narada4d => ../..
@@ -0,0 +1,146 @@
+// Package prometheus provides schemaver.Observer which collects
+// Prometheus metrics.
+//
+// It's a separate module to not add Prometheus dependencies to users
+// of narada4d who don't need it.
+package prometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+const (
+	subsystem = "narada4d"
+	labelType = "type"
+	labelOp   = "op"
+)
+
+// Observer implements schemaver.Observer and prometheus.Collector.
+type Observer struct {
+	lockWaiting *prometheus.GaugeVec
+	lockWait    *prometheus.HistogramVec
+	lockHeld    *prometheus.HistogramVec
+	opDuration  *prometheus.HistogramVec
+	errors      *prometheus.CounterVec
+}
+
+var (
+	_ schemaver.Observer   = (*Observer)(nil)
+	_ prometheus.Collector = (*Observer)(nil)
+)
+
+// New creates Observer with metrics using given namespace (may be empty)
+// and "narada4d" subsystem. It must be registered using
+// prometheus.Register to export metrics:
+//
+//   - lock_waiting{type}: amount of currently waiting lock requests
+//   - lock_wait_seconds{type}: time spent waiting for a lock
+//   - lock_held_seconds{type}: time lock was held
+//   - op_duration_seconds{op}: duration of Get and Set
+//   - backend_errors_total{op}: errors returned by protocol
+//
+// Label type is "shared" or "exclusive", label op is a name of
+// schemaver.Manage method (like "Get" or "ExclusiveLock").
+func New(namespace string) *Observer {
+	return &Observer{
+		lockWaiting: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "lock_waiting",
+				Help:      "Amount of currently waiting lock requests.",
+			},
+			[]string{labelType},
+		),
+		lockWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "lock_wait_seconds",
+				Help:      "Time spent waiting for a lock.",
+			},
+			[]string{labelType},
+		),
+		lockHeld: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "lock_held_seconds",
+				Help:      "Time lock was held.",
+			},
+			[]string{labelType},
+		),
+		opDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "op_duration_seconds",
+				Help:      "Duration of Get and Set.",
+			},
+			[]string{labelOp},
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "backend_errors_total",
+				Help:      "Errors returned by protocol.",
+			},
+			[]string{labelOp},
+		),
+	}
+}
+
+func (o *Observer) collectors() []prometheus.Collector {
+	return []prometheus.Collector{o.lockWaiting, o.lockWait, o.lockHeld, o.opDuration, o.errors}
+}
+
+// Describe implements prometheus.Collector.
+func (o *Observer) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range o.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (o *Observer) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range o.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// LockRequested implements schemaver.Observer.
+func (o *Observer) LockRequested(_ context.Context, typ schemaver.LockType) {
+	o.lockWaiting.WithLabelValues(typ.String()).Inc()
+}
+
+// LockAcquired implements schemaver.Observer.
+func (o *Observer) LockAcquired(_ context.Context, typ schemaver.LockType, wait time.Duration, _ error) {
+	o.lockWaiting.WithLabelValues(typ.String()).Dec()
+	o.lockWait.WithLabelValues(typ.String()).Observe(wait.Seconds())
+}
+
+// LockReleased implements schemaver.Observer.
+func (o *Observer) LockReleased(_ context.Context, typ schemaver.LockType, held time.Duration, _ error) {
+	o.lockHeld.WithLabelValues(typ.String()).Observe(held.Seconds())
+}
+
+// Get implements schemaver.Observer.
+func (o *Observer) Get(_ context.Context, _ schemaver.Version, d time.Duration, _ error) {
+	o.opDuration.WithLabelValues("Get").Observe(d.Seconds())
+}
+
+// Set implements schemaver.Observer.
+func (o *Observer) Set(_ context.Context, _ schemaver.Version, d time.Duration, _ error) {
+	o.opDuration.WithLabelValues("Set").Observe(d.Seconds())
+}
+
+// BackendError implements schemaver.Observer.
+func (o *Observer) BackendError(_ context.Context, op string, _ error) {
+	o.errors.WithLabelValues(op).Inc()
+}
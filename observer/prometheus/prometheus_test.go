@@ -0,0 +1,43 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+func TestObserver(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+
+	o := New("test")
+	reg := prometheus.NewPedanticRegistry()
+	t.Nil(reg.Register(o))
+
+	o.LockRequested(ctx, schemaver.LockShared)
+	o.LockRequested(ctx, schemaver.LockShared)
+	t.Equal(testutil.ToFloat64(o.lockWaiting.WithLabelValues("shared")), 2.0)
+	o.LockAcquired(ctx, schemaver.LockShared, time.Second, nil)
+	t.Equal(testutil.ToFloat64(o.lockWaiting.WithLabelValues("shared")), 1.0)
+	o.LockReleased(ctx, schemaver.LockShared, time.Second, nil)
+	o.LockRequested(ctx, schemaver.LockExclusive)
+	o.LockAcquired(ctx, schemaver.LockExclusive, time.Second, nil)
+	o.Get(ctx, "42", time.Millisecond, nil)
+	o.Set(ctx, "43", time.Millisecond, nil)
+	o.BackendError(ctx, "Set", errors.New("some error"))
+	t.Equal(testutil.ToFloat64(o.errors.WithLabelValues("Set")), 1.0)
+
+	n, err := testutil.GatherAndCount(reg)
+	t.Nil(err)
+	t.Equal(n, 8)
+	n, err = testutil.GatherAndCount(reg, "test_narada4d_lock_wait_seconds")
+	t.Nil(err)
+	t.Equal(n, 2)
+}
@@ -2,46 +2,65 @@
 package file
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
 
 	"github.com/powerman/narada4d/schemaver"
 )
 
 const (
 	versionFileName   = ".version"
+	noteFileName      = ".version.note"
 	lockFileName      = ".lock"
 	lockQueueFileName = ".lock.queue"
 )
 
 var (
-	errVersionAlreadyInitialized = errors.New("version is already initialized")
-	errLocationInvalid           = errors.New("location must contain only path")
-	errLocationWrongPath         = errors.New("location path must be existing directory")
+	errLocationInvalid   = errors.New("location must contain only path")
+	errLocationWrongPath = errors.New("location path must be existing directory")
 )
 
 type storage struct {
 	versionPath   string
+	notePath      string
 	lockPath      string
 	lockQueuePath string
 	lockFile      *os.File
 	lockQueueFile *os.File
 	lockFD        int
 	lockQueueFD   int
+	tokenFD       int // Inherited by child processes, -1 if none.
 }
 
 func init() {
 	schemaver.RegisterProtocol("file", schemaver.Backend{
 		Initialize: initialize,
 		New:        newInitializedStorage,
+		Canonical:  canonical,
 	})
 }
 
+// canonical cleans path and resolves symlinks (if path exists).
+func canonical(loc *url.URL) *url.URL {
+	if loc.Path != "" {
+		loc.Path, loc.RawPath = filepath.Clean(loc.Path), ""
+		if path, err := filepath.EvalSymlinks(loc.Path); err == nil {
+			loc.Path = path
+		}
+	}
+	return loc
+}
+
 func initialize(loc *url.URL) error {
 	s, err := newStorage(loc)
 	if err != nil {
@@ -49,7 +68,7 @@ func initialize(loc *url.URL) error {
 	}
 
 	if s.initialized() {
-		return fmt.Errorf("%w at %q", errVersionAlreadyInitialized, s.versionPath)
+		return fmt.Errorf("version is %w at %q", schemaver.ErrAlreadyInitialized, s.versionPath)
 	}
 	return s.init()
 }
@@ -83,8 +102,10 @@ func newStorage(loc *url.URL) (*storage, error) {
 
 	s := &storage{
 		versionPath:   filepath.Join(loc.Path, versionFileName),
+		notePath:      filepath.Join(loc.Path, noteFileName),
 		lockPath:      filepath.Join(loc.Path, lockFileName),
 		lockQueuePath: filepath.Join(loc.Path, lockQueueFileName),
+		tokenFD:       -1,
 	}
 	return s, nil
 }
@@ -120,51 +141,234 @@ func (s *storage) open() (err error) {
 }
 
 func (s *storage) SharedLock() {
-	s.lock(syscall.LOCK_SH)
+	if err := s.SharedLockContext(context.Background()); err != nil {
+		panic(err)
+	}
 }
 
 func (s *storage) ExclusiveLock() {
-	s.lock(syscall.LOCK_EX)
+	if err := s.ExclusiveLockContext(context.Background()); err != nil {
+		panic(err)
+	}
 }
 
-func (s *storage) lock(how int) {
-	if err := syscall.Flock(s.lockQueueFD, syscall.LOCK_EX); err != nil {
-		panic(err)
+func (s *storage) SharedLockContext(ctx context.Context) error {
+	return s.lock(syscall.LOCK_SH, func(fd, how int) error { return flock(ctx, fd, how) })
+}
+
+func (s *storage) ExclusiveLockContext(ctx context.Context) error {
+	return s.lock(syscall.LOCK_EX, func(fd, how int) error { return flock(ctx, fd, how) })
+}
+
+func (s *storage) TrySharedLock() error {
+	return s.lock(syscall.LOCK_SH, tryFlock)
+}
+
+func (s *storage) TryExclusiveLock() error {
+	return s.lock(syscall.LOCK_EX, tryFlock)
+}
+
+func (s *storage) lock(how int, flock func(fd, how int) error) error {
+	if err := flock(s.lockQueueFD, syscall.LOCK_EX); err != nil {
+		return err
 	}
-	if err := syscall.Flock(s.lockFD, how); err != nil {
-		panic(err)
+	err := flock(s.lockFD, how)
+	if errUnlock := syscall.Flock(s.lockQueueFD, syscall.LOCK_UN); err == nil && errUnlock != nil {
+		_ = syscall.Flock(s.lockFD, syscall.LOCK_UN)
+		err = errUnlock
 	}
-	if err := syscall.Flock(s.lockQueueFD, syscall.LOCK_UN); err != nil {
-		panic(err)
+	return err
+}
+
+func tryFlock(fd, how int) error {
+	err := syscall.Flock(fd, how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return schemaver.ErrWouldBlock
+	}
+	return err
+}
+
+// flock will block until lock is acquired if ctx can't be cancelled,
+// otherwise it'll poll for lock until it's acquired or ctx.Done.
+func flock(ctx context.Context, fd, how int) error {
+	if ctx.Done() == nil {
+		return syscall.Flock(fd, how)
+	}
+	op := func() error {
+		err := syscall.Flock(fd, how|syscall.LOCK_NB)
+		if err != nil && !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			err = backoff.Permanent(err)
+		}
+		return err
 	}
+	return backoff.Retry(op, backoff.WithContext(newPollBackOff(), ctx))
+}
+
+func newPollBackOff() backoff.BackOff {
+	const (
+		initialInterval = time.Millisecond
+		maxInterval     = time.Second / 10
+	)
+	backOff := backoff.NewExponentialBackOff()
+	backOff.InitialInterval = initialInterval
+	backOff.MaxInterval = maxInterval
+	backOff.MaxElapsedTime = 0
+	return backOff
 }
 
 func (s *storage) Unlock() {
-	if err := syscall.Flock(s.lockFD, syscall.LOCK_UN); err != nil {
+	if err := s.UnlockErr(); err != nil {
 		panic(err)
 	}
 }
 
+func (s *storage) UnlockErr() error {
+	s.closeToken()
+	return syscall.Flock(s.lockFD, syscall.LOCK_UN)
+}
+
+// Downgrade implements schemaver.ManageDowngrade. Converting exclusive
+// flock into shared never blocks and thus is atomic.
+func (s *storage) Downgrade() error {
+	s.closeToken()
+	return syscall.Flock(s.lockFD, syscall.LOCK_SH)
+}
+
+// Token implements schemaver.ManageToken. Token is a number of file
+// descriptor of .lock file without close-on-exec flag, so it'll be
+// inherited by child processes.
+func (s *storage) Token() (string, error) {
+	if s.tokenFD == -1 {
+		fd, err := syscall.Dup(s.lockFD)
+		if err != nil {
+			return "", err
+		}
+		s.tokenFD = fd
+	}
+	return strconv.Itoa(s.tokenFD), nil
+}
+
+func (s *storage) closeToken() {
+	if s.tokenFD != -1 {
+		_ = syscall.Close(s.tokenFD)
+		s.tokenFD = -1
+	}
+}
+
+// VerifyToken implements schemaver.ManageToken. Token is valid if it's
+// an open file descriptor of .lock file, someone holds exclusive lock on
+// .lock file and it's held using this file descriptor (i.e. it was
+// inherited from lock owner, not opened by child process).
+//
+// Verification doesn't change lock state. Use of this file descriptor
+// for holding lock is checked only on Linux (using /proc/self/fdinfo),
+// on other OS it's enough that someone holds lock on .lock file.
+func (s *storage) VerifyToken(token string) error {
+	fd, err := strconv.Atoi(token)
+	if err != nil || fd < 0 || fd == s.lockFD || fd == s.lockQueueFD {
+		return fmt.Errorf("%w: bad file descriptor %q", schemaver.ErrInvalidToken, token)
+	}
+	var st, stLock syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("%w: file descriptor %d: %v", schemaver.ErrInvalidToken, fd, err)
+	}
+	if err := syscall.Fstat(s.lockFD, &stLock); err != nil {
+		return err
+	}
+	if st.Dev != stLock.Dev || st.Ino != stLock.Ino {
+		return fmt.Errorf("%w: file descriptor %d is not %s", schemaver.ErrInvalidToken, fd, s.lockPath)
+	}
+	err = tryFlock(s.lockFD, syscall.LOCK_SH)
+	if err == nil {
+		_ = syscall.Flock(s.lockFD, syscall.LOCK_UN)
+		return fmt.Errorf("%w: %s is not locked", schemaver.ErrInvalidToken, s.lockPath)
+	} else if !errors.Is(err, schemaver.ErrWouldBlock) {
+		return err
+	}
+	locked, err := lockedExclusive(fd)
+	if err == nil && !locked {
+		err = fmt.Errorf("%w: %s is not locked using file descriptor %d", schemaver.ErrInvalidToken, s.lockPath, fd)
+	}
+	return err
+}
+
+// ExclusivePending implements schemaver.ManagePending. Exclusive lock
+// waiter keeps lock on .lock.queue while waiting for lock on .lock.
+// Shared lock waiters also lock .lock.queue for a short time, so it may
+// report false positive.
+func (s *storage) ExclusivePending() (bool, error) {
+	err := tryFlock(s.lockQueueFD, syscall.LOCK_EX)
+	if errors.Is(err, schemaver.ErrWouldBlock) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, syscall.Flock(s.lockQueueFD, syscall.LOCK_UN)
+}
+
 func (s *storage) Get() string {
-	ver, err := os.Readlink(s.versionPath)
+	ver, err := s.GetErr()
 	if err != nil {
 		panic(err)
 	}
 	return ver
 }
 
+func (s *storage) GetErr() (string, error) {
+	return os.Readlink(s.versionPath)
+}
+
 func (s *storage) Set(ver string) {
+	if err := s.SetErr(ver); err != nil {
+		panic(err)
+	}
+}
+
+func (s *storage) SetErr(ver string) error {
 	tmpPath := s.versionPath + ".tmp"
 	_ = os.Remove(tmpPath)
 	if err := os.Symlink(ver, tmpPath); err != nil {
-		panic(err)
+		return err
 	}
-	if err := os.Rename(tmpPath, s.versionPath); err != nil {
-		panic(err)
+	return os.Rename(tmpPath, s.versionPath)
+}
+
+// SetIf implements schemaver.ManageSetIf. It's atomic because version
+// is changed only under exclusive lock.
+func (s *storage) SetIf(expected, ver string) error {
+	actual, err := s.GetErr()
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return &schemaver.VersionConflictError{
+			Expected: schemaver.Version(expected),
+			Actual:   schemaver.Version(actual),
+		}
+	}
+	return s.SetErr(ver)
+}
+
+// Note implements schemaver.ManageNote.
+func (s *storage) Note() (string, error) {
+	buf, err := ioutil.ReadFile(s.notePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return string(buf), err
+}
+
+// SetNote implements schemaver.ManageNote.
+func (s *storage) SetNote(note string) error {
+	tmpPath := s.notePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(note), 0o644); err != nil { //nolint:gosec // Not a secret.
+		return err
 	}
+	return os.Rename(tmpPath, s.notePath)
 }
 
 func (s *storage) Close() error {
+	s.closeToken()
 	err := s.lockFile.Close()
 	if err == nil {
 		err = s.lockQueueFile.Close()
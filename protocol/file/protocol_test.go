@@ -1,15 +1,21 @@
 package file
 
 import (
+	"context"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
 )
 
 func TestBadLocation(tt *testing.T) {
@@ -34,6 +40,37 @@ func TestBadLocation(tt *testing.T) {
 	}
 }
 
+func TestCanonical(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer os.RemoveAll(tempdir)
+	t.Nil(os.Mkdir(tempdir+"/dir", 0o755))
+	t.Nil(os.Symlink(tempdir+"/dir", tempdir+"/link"))
+	dir, err := filepath.EvalSymlinks(tempdir + "/dir")
+	t.Nil(err)
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"file://", "file:"},
+		{dir, dir},
+		{dir + "/", dir},
+		{dir + "/./sub/..", dir},
+		{tempdir + "/link/", dir},
+		{tempdir + "/link/../nonexistent/", tempdir + "/nonexistent"},
+	}
+	for _, v := range cases {
+		loc, err := url.Parse(v.path)
+		t.Nil(err)
+		want, err := url.Parse(v.want)
+		t.Nil(err)
+		t.Equal(canonical(loc).String(), want.String(), v.path)
+	}
+}
+
 func TestInitialize(tt *testing.T) {
 	t := check.T(tt)
 
@@ -250,6 +287,196 @@ func TestExPriority(tt *testing.T) {
 	un3 <- struct{}{}
 }
 
+// - EX1, SH2 (ctx.Done), EX2 (ctx.Done), UN1, SH2, UN2.
+func TestLockContext(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s1, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s1.open())
+	defer s1.Close()
+	s2, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s2.open())
+	defer s2.Close()
+
+	t.Nil(s1.ExclusiveLockContext(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t.Err(s2.SharedLockContext(ctx), context.DeadlineExceeded)
+	t.Err(s2.ExclusiveLockContext(ctx), context.DeadlineExceeded)
+	s1.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t.Nil(s2.SharedLockContext(ctx))
+	s2.Unlock()
+}
+
+// - TryEX1, TrySH2 (would block), TryEX2 (would block), UN1, TrySH2, TrySH1, UN1, TryEX1 (would block), UN2.
+func TestTryLock(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s1, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s1.open())
+	defer s1.Close()
+	s2, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s2.open())
+	defer s2.Close()
+
+	t.Nil(s1.TryExclusiveLock())
+	t.Err(s2.TrySharedLock(), schemaver.ErrWouldBlock)
+	t.Err(s2.TryExclusiveLock(), schemaver.ErrWouldBlock)
+	t.Nil(s1.UnlockErr())
+	t.Nil(s2.TrySharedLock())
+	t.Nil(s1.TrySharedLock())
+	t.Nil(s1.UnlockErr())
+	t.Err(s1.TryExclusiveLock(), schemaver.ErrWouldBlock)
+	t.Nil(s2.UnlockErr())
+}
+
+func TestDowngrade(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s1, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s1.open())
+	defer s1.Close()
+	s2, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s2.open())
+	defer s2.Close()
+
+	t.Nil(s1.TryExclusiveLock())
+	t.Err(s2.TrySharedLock(), schemaver.ErrWouldBlock)
+	t.Nil(s1.Downgrade())
+	t.Nil(s2.TrySharedLock())
+	t.Nil(s2.UnlockErr())
+	t.Err(s2.TryExclusiveLock(), schemaver.ErrWouldBlock)
+	t.Nil(s1.UnlockErr())
+}
+
+func TestExclusivePending(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s1, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s1.open())
+	defer s1.Close()
+	s2, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s2.open())
+	defer s2.Close()
+
+	t.Nil(s1.TrySharedLock())
+	pending, err := s1.ExclusivePending()
+	t.Nil(err)
+	t.False(pending)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- s2.ExclusiveLockContext(ctx) }()
+	time.Sleep(time.Second / 10)
+	pending, err = s1.ExclusivePending()
+	t.Nil(err)
+	t.True(pending)
+
+	cancel()
+	t.Err(<-errc, context.Canceled)
+	pending, err = s1.ExclusivePending()
+	t.Nil(err)
+	t.False(pending)
+	t.Nil(s1.UnlockErr())
+}
+
+func TestToken(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s1, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s1.open())
+	defer s1.Close()
+	s2, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s2.open())
+	defer s2.Close()
+
+	// - EX, Token, Token (same), inherited by child process
+	t.Nil(s1.TryExclusiveLock())
+	token, err := s1.Token()
+	t.Nil(err)
+	token2, err := s1.Token()
+	t.Nil(err)
+	t.Equal(token2, token)
+	t.Nil(exec.Command("sh", "-c", "test -e /dev/fd/"+token).Run())
+
+	// - VerifyToken: valid, invalid
+	t.Nil(s2.VerifyToken(token))
+	for _, token := range []string{"", "x", "-1", "0", strconv.Itoa(s2.lockFD), strconv.Itoa(s2.lockQueueFD)} {
+		t.Err(s2.VerifyToken(token), schemaver.ErrInvalidToken, token)
+	}
+
+	// - VerifyToken: forged (.lock opened by child), invalid
+	forged, err := os.Open(s1.lockPath)
+	t.Nil(err)
+	t.Match(s2.VerifyToken(strconv.Itoa(int(forged.Fd()))), `not locked using file descriptor`)
+	t.Nil(forged.Close())
+	t.Nil(s2.VerifyToken(token))
+
+	// - Downgrade, VerifyToken: invalid
+	t.Nil(s1.Downgrade())
+	t.Err(s2.VerifyToken(token), schemaver.ErrInvalidToken)
+	t.Nil(s1.UnlockErr())
+
+	// - EX, Token, UN, VerifyToken: invalid
+	t.Nil(s1.TryExclusiveLock())
+	token, err = s1.Token()
+	t.Nil(err)
+	t.Nil(s1.UnlockErr())
+	t.Err(s2.VerifyToken(token), schemaver.ErrInvalidToken)
+}
+
 // - Get = "none", Get = "none".
 func TestGetNone(tt *testing.T) {
 	t := check.T(tt)
@@ -298,6 +525,63 @@ func TestSet(tt *testing.T) {
 	}
 }
 
+func TestSetIf(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	p, err := newInitializedStorage(loc)
+	t.Nil(err)
+	defer cleanup(t, tempdir)
+
+	p.ExclusiveLock()
+	defer p.Unlock()
+	s := p.(schemaver.ManageSetIf)
+
+	t.Nil(s.SetIf("none", "1"))
+	t.Equal(p.Get(), "1")
+	t.Nil(s.SetIf("1", "1"))
+	t.Equal(p.Get(), "1")
+
+	err = s.SetIf("none", "2")
+	t.DeepEqual(err, &schemaver.VersionConflictError{Expected: "none", Actual: "1"})
+	t.Equal(p.Get(), "1")
+}
+
+func TestNote(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	p, err := newInitializedStorage(loc)
+	t.Nil(err)
+	defer cleanup(t, tempdir)
+
+	p.ExclusiveLock()
+	defer p.Unlock()
+	s := p.(schemaver.ManageNote)
+
+	t.Equal(must(s.Note()), "")
+	t.Nil(s.SetNote("migrating"))
+	t.Equal(must(s.Note()), "migrating")
+	t.Nil(s.SetNote("failed\n"))
+	t.Equal(must(s.Note()), "failed\n")
+	t.Nil(os.Remove(tempdir + "/.version.note"))
+}
+
+func must(s string, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
 func cleanup(t *check.C, tempdir string) {
 	t.Nil(os.Remove(tempdir + "/.lock"))
 	t.Nil(os.Remove(tempdir + "/.lock.queue"))
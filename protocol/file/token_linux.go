@@ -0,0 +1,29 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lockedExclusive returns true if exclusive lock is held using open file
+// description referred by fd. It reads /proc/self/fdinfo to avoid
+// changing lock state.
+func lockedExclusive(fd int) (bool, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/self/fdinfo/%d", fd))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() //nolint:errcheck // Read-only.
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// lock:	1: FLOCK  ADVISORY  WRITE 1234 fe:00:5678 0 EOF
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[0] == "lock:" && fields[2] == "FLOCK" && fields[4] == "WRITE" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
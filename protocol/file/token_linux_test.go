@@ -0,0 +1,68 @@
+package file
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+func TestLockedExclusive(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s1, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s1.open())
+	defer s1.Close()
+	s2, err := newStorage(loc)
+	t.Nil(err)
+	t.Nil(s2.open())
+	defer s2.Close()
+
+	isLocked := func(fd int, want bool) {
+		t.Helper()
+		locked, err := lockedExclusive(fd)
+		t.Nil(err)
+		t.Equal(locked, want)
+	}
+
+	// - UN, SH: false
+	isLocked(s1.lockFD, false)
+	t.Nil(s1.TrySharedLock())
+	isLocked(s1.lockFD, false)
+	t.Nil(s1.UnlockErr())
+
+	// - EX: true (also for dup), false for another open file description
+	t.Nil(s1.TryExclusiveLock())
+	token, err := s1.Token()
+	t.Nil(err)
+	isLocked(s1.lockFD, true)
+	isLocked(s1.tokenFD, true)
+	isLocked(s2.lockFD, false)
+
+	// - VerifyToken doesn't change lock state
+	t.Nil(s2.VerifyToken(token))
+	t.Nil(s1.Downgrade())
+	t.Err(s2.VerifyToken(token), schemaver.ErrInvalidToken)
+	t.Nil(s2.TrySharedLock())
+	t.Nil(s2.UnlockErr())
+	t.Nil(s1.UnlockErr())
+	t.Nil(s2.TryExclusiveLock())
+	t.Nil(s2.UnlockErr())
+
+	// - bad fd
+	_, err = lockedExclusive(-1)
+	t.NotNil(err)
+}
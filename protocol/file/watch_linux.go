@@ -0,0 +1,53 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const inotifyBufSize = 4096
+
+// Watch implements schemaver.ManageWatch using inotify on directory
+// with version file (version is changed by renaming symlink).
+func (s *storage) Watch(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "inotify") // Non-blocking fd: Close will interrupt Read.
+	const mask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_DELETE
+	_, err = syscall.InotifyAddWatch(fd, filepath.Dir(s.versionPath), mask)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	c := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = f.Close()
+	}()
+	go func() {
+		defer close(c)
+		defer close(done)
+		buf := make([]byte, inotifyBufSize)
+		for {
+			// Events for other files in same directory are rare,
+			// so there is no reason to filter them out.
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,55 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestWatch(tt *testing.T) {
+	t := check.T(tt)
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer func() { t.Nil(os.Remove(tempdir)) }()
+	loc, err := url.Parse("file://" + tempdir)
+	t.Nil(err)
+	t.Nil(initialize(loc))
+	defer cleanup(t, tempdir)
+
+	s, err := newStorage(loc)
+	t.Nil(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := s.Watch(ctx)
+	t.Nil(err)
+
+	recv := func() (ok bool) {
+		select {
+		case _, ok = <-c:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+		return ok
+	}
+
+	t.Nil(s.SetErr("1"))
+	t.True(recv())
+	t.Nil(s.SetErr("2"))
+	t.True(recv())
+	cancel()
+	deadline := time.After(time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-c: // Notification sent before cancel may be received.
+			closed = !ok
+		case <-deadline:
+			t.Fatal("not closed after cancel")
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/powerman/mysqlx"
 
 	"github.com/powerman/narada4d/internal"
+	"github.com/powerman/narada4d/schemaver"
 )
 
 const (
@@ -66,7 +67,7 @@ func setupIntegration() {
 
 func dropTable(t *check.C) {
 	t.Helper()
-	s, err := newStorage(loc)
+	s, err := newStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	_, err = s.db.Exec(sqlDropTable)
 	t.Nil(err)
@@ -74,7 +75,7 @@ func dropTable(t *check.C) {
 }
 
 func testLock(name string, loc *url.URL, unlockc chan struct{}, statusc chan string) {
-	v, err := newStorage(loc)
+	v, err := newStorage(loc, schemaver.Options{})
 	if err != nil {
 		panic(err)
 	}
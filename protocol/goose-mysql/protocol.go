@@ -5,19 +5,22 @@ import (
 	"database/sql"
 	"errors"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 
-	"github.com/cenkalti/backoff/v4"
 	"github.com/go-sql-driver/mysql"
 	"github.com/powerman/goose"
 	"github.com/powerman/must"
 
 	"github.com/powerman/narada4d/internal"
+	"github.com/powerman/narada4d/internal/mysqllock"
 	"github.com/powerman/narada4d/schemaver"
 )
 
 const (
+	defaultPort = "3306"
+
 	sqlCreateTable = `
 CREATE TABLE Narada4D (
 	 var VARCHAR(191) PRIMARY KEY
@@ -25,57 +28,107 @@ CREATE TABLE Narada4D (
 )
 SELECT "version_from" as var, "goose" as val
 `
-	sqlInitialized   = `SELECT COUNT(*) FROM Narada4D`
-	sqlSharedLock    = `LOCK TABLES Narada4D READ`
-	sqlExclusiveLock = `LOCK TABLES Narada4D WRITE`
-	sqlUnlock        = `UNLOCK TABLES`
+	sqlCurrent     = `SELECT SUBSTRING_INDEX(USER(), '@', 1), COALESCE(DATABASE(), '')`
+	sqlInitialized = `SELECT COUNT(*) FROM Narada4D`
 )
 
-var (
-	errAlreadyInitialized = errors.New("already initialized")
-	errLocked             = errors.New("locked")
-)
+var errConfigRequireTCP = errors.New("require mysql.Config with tcp network and address")
 
 type storage struct {
+	*mysqllock.Locker
 	db    *sql.DB
-	tx    *sql.Tx
+	extDB bool // Do not close db, it's owned by caller.
 	goose *goose.Instance
 }
 
 func init() {
 	schemaver.RegisterProtocol("goose-mysql", schemaver.Backend{
-		Initialize: initialize,
-		New:        newInitializedStorage,
+		Initialize:     initialize,
+		NewWithOptions: newInitializedStorage,
+		Canonical:      canonical,
 	})
 }
 
+// canonical adds default port, cleans path and removes timeout query
+// param (it doesn't change location).
+func canonical(loc *url.URL) *url.URL {
+	loc.Host = internal.HostWithPort(loc.Host, defaultPort)
+	if loc.Path != "" {
+		loc.Path, loc.RawPath = path.Clean(loc.Path), ""
+	}
+	if q := loc.Query(); q.Get("timeout") != "" {
+		q.Del("timeout")
+		loc.RawQuery = q.Encode()
+	}
+	return loc
+}
+
 func initialize(loc *url.URL) error {
-	s, err := newStorage(loc)
+	s, err := newStorage(loc, schemaver.Options{})
 	if err != nil {
 		return err
 	}
 	defer s.Close() //nolint:errcheck // Defer.
 
 	if s.initialized() {
-		return errAlreadyInitialized
+		return schemaver.ErrAlreadyInitialized
 	}
 	return s.init()
 }
 
-func newInitializedStorage(loc *url.URL) (schemaver.Manage, error) {
-	s, err := newStorage(loc)
+func newInitializedStorage(loc *url.URL, opts schemaver.Options) (schemaver.Manage, error) {
+	s, err := newStorage(loc, opts)
 	if err != nil {
 		return nil, err
 	}
-	if !s.initialized() {
-		if err := s.init(); err != nil {
-			_ = s.Close()
-			return nil, err
-		}
+	if err := s.ensureInitialized(); err != nil {
+		_ = s.Close()
+		return nil, err
 	}
 	return s, nil
 }
 
+// NewWithDB creates object for managing data schema version in database
+// used by db instead of opening own connection pool.
+//
+// Will initialize version if it's not initialized yet.
+//
+// Lock pins a dedicated connection from db until unlock, so db pool
+// must allow one more connection per returned object (plus one more
+// while Watch is running). Closing returned object won't close db.
+//
+// Location used to identify version (see schemaver.EnvSkipLock) is
+// goose-mysql://user@host:port/database with cfg.Addr and current user and
+// database, so cfg must be the one used to open db (e.g. using
+// mysql.NewConnector or cfg.FormatDSN).
+func NewWithDB(db *sql.DB, cfg *mysql.Config, opts ...schemaver.Option) (*schemaver.SchemaVer, error) {
+	if cfg.Net != "" && cfg.Net != "tcp" || cfg.Addr == "" {
+		return nil, errConfigRequireTCP
+	}
+	var user, database string
+	err := db.QueryRow(sqlCurrent).Scan(&user, &database)
+	if err != nil {
+		return nil, err
+	}
+	loc := &url.URL{Scheme: "goose-mysql", User: url.User(user), Host: cfg.Addr, Path: "/" + database}
+	return schemaver.NewWithManage(loc.String(), func(opts schemaver.Options) (schemaver.Manage, error) {
+		s := &storage{
+			Locker: mysqllock.New("goose-mysql", db, opts),
+			db:     db,
+			extDB:  true,
+			goose:  goose.NewInstance(),
+		}
+		err := s.goose.SetDialect("mysql")
+		if err == nil {
+			err = s.ensureInitialized()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, opts...)
+}
+
 func dsn(loc *url.URL) string {
 	dsn := &url.URL{}
 	*dsn = *loc
@@ -83,7 +136,11 @@ func dsn(loc *url.URL) string {
 	return strings.TrimPrefix(dsn.String(), "goose-mysql://")
 }
 
-func newStorage(loc *url.URL) (*storage, error) {
+func newStorage(loc *url.URL, opts schemaver.Options) (*storage, error) {
+	if q := loc.Query(); opts.DialTimeout != 0 && q.Get("timeout") == "" {
+		q.Set("timeout", opts.DialTimeout.String())
+		loc.RawQuery = q.Encode()
+	}
 	db, err := sql.Open("mysql", dsn(loc))
 	if err != nil {
 		return nil, err
@@ -95,8 +152,9 @@ func newStorage(loc *url.URL) (*storage, error) {
 	}
 
 	s := &storage{
-		db:    db,
-		goose: goose.NewInstance(),
+		Locker: mysqllock.New("goose-mysql", db, opts),
+		db:     db,
+		goose:  goose.NewInstance(),
 	}
 	err = s.goose.SetDialect("mysql")
 	if err != nil {
@@ -106,6 +164,13 @@ func newStorage(loc *url.URL) (*storage, error) {
 	return s, nil
 }
 
+func (s *storage) ensureInitialized() error {
+	if s.initialized() {
+		return nil
+	}
+	return s.init()
+}
+
 func (s *storage) initialized() bool {
 	var count int
 	_ = s.db.QueryRow(sqlInitialized).Scan(&count)
@@ -120,71 +185,37 @@ func (s *storage) init() error {
 	return err
 }
 
-func (s *storage) SharedLock() {
-	if s.tx != nil {
-		panic("already locked")
-	}
-	op := func() (err error) {
-		s.tx, err = s.db.Begin()
-		if err == nil {
-			_, err = s.tx.Exec(sqlSharedLock)
-		}
-		if errors.As(err, new(*mysql.MySQLError)) { // Retry on network errors.
-			err = backoff.Permanent(err)
-		}
-		return err
-	}
-	must.PanicIf(backoff.Retry(op, internal.NewBackOff()))
-}
-
-func (s *storage) ExclusiveLock() {
-	if s.tx != nil {
-		panic("already locked")
-	}
-	op := func() (err error) {
-		s.tx, err = s.db.Begin()
-		if err == nil {
-			_, err = s.tx.Exec(sqlExclusiveLock)
-		}
-		if errors.As(err, new(*mysql.MySQLError)) { // Retry on network errors.
-			err = backoff.Permanent(err)
-		}
-		return err
-	}
-	must.PanicIf(backoff.Retry(op, internal.NewBackOff()))
-}
-
-func (s *storage) Unlock() {
-	if s.tx == nil {
-		panic("not locked")
-	}
-	_, err := s.tx.Exec(sqlUnlock)
-	if err == nil {
-		err = s.tx.Commit()
-	}
-	s.tx = nil
-	if err != nil && !errors.As(err, new(*mysql.MySQLError)) { // Ignore network errors.
-		err = nil
-	}
+func (s *storage) Get() string {
+	ver, err := s.GetErr()
 	must.PanicIf(err)
+	return ver
 }
 
-func (s *storage) Get() string {
+func (s *storage) GetErr() (string, error) {
 	v, err := goose.EnsureDBVersion(s.db)
-	must.PanicIf(err)
+	if err != nil {
+		return "", err
+	}
 	if v == 0 {
-		return "none"
+		return "none", nil
 	}
-	return strconv.Itoa(int(v))
+	return strconv.Itoa(int(v)), nil
 }
 
-func (s *storage) Set(string) {
-	panic("not supported")
+func (s *storage) Set(ver string) {
+	must.PanicIf(s.SetErr(ver))
+}
+
+func (s *storage) SetErr(string) error {
+	return schemaver.ErrNotSupported
 }
 
 func (s *storage) Close() error {
-	if s.tx != nil {
-		return errLocked
+	if s.Tx() != nil {
+		return schemaver.ErrLocked
+	}
+	if s.extDB {
+		return nil
 	}
 	return s.db.Close()
 }
@@ -3,14 +3,38 @@
 package goosemysql
 
 import (
+	"context"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/powerman/check"
 
 	"github.com/powerman/narada4d/internal"
+	"github.com/powerman/narada4d/schemaver"
 )
 
+func TestCanonical(tt *testing.T) {
+	t := check.T(tt)
+
+	cases := []struct {
+		loc  string
+		want string
+	}{
+		{"goose-mysql://u@Host/db", "goose-mysql://u@host:3306/db"},
+		{"goose-mysql://u@host:3306/db/?timeout=3s", "goose-mysql://u@host:3306/db"},
+		{"goose-mysql://u@host:3307/db?timeout=3s&tls=true", "goose-mysql://u@host:3307/db?tls=true"},
+	}
+	for _, v := range cases {
+		loc, err := url.Parse(v.loc)
+		t.Nil(err)
+		loc.Host = strings.ToLower(loc.Host) // Done by schemaver.
+		t.Equal(canonical(loc).String(), v.want, v.loc)
+	}
+}
+
 func TestInitialize(tt *testing.T) {
 	t := check.T(tt)
 	t.Nil(initialize(loc))
@@ -20,7 +44,7 @@ func TestInitialize(tt *testing.T) {
 func TestInitialized(tt *testing.T) {
 	t := check.T(tt)
 
-	s, err := newStorage(loc)
+	s, err := newStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	defer s.Close()
 
@@ -131,21 +155,72 @@ func TestExPriority(tt *testing.T) {
 	un3 <- struct{}{}
 }
 
+// - EX1, TrySH2 (would block), TryEX2 (would block), UN1, TryEX2, UN2.
+func TestTryLock(tt *testing.T) {
+	t := check.T(tt)
+
+	t.Nil(initialize(loc))
+	defer dropTable(t)
+
+	s1, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s1.Close()
+	s2, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s2.Close()
+
+	t.Nil(s1.TryExclusiveLock())
+	t.Err(s2.TrySharedLock(), schemaver.ErrWouldBlock)
+	t.Err(s2.TryExclusiveLock(), schemaver.ErrWouldBlock)
+	t.Nil(s1.UnlockErr())
+	t.Nil(s2.TryExclusiveLock())
+	t.Nil(s2.UnlockErr())
+}
+
+// - SH1, not pending, EX2 (block), pending, UN1, EX2.
+func TestExclusivePending(tt *testing.T) {
+	t := check.T(tt)
+
+	t.Nil(initialize(loc))
+	defer dropTable(t)
+
+	s1, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s1.Close()
+
+	t.Nil(s1.SharedLockContext(context.Background()))
+	pending, err := s1.ExclusivePending()
+	t.Nil(err)
+	t.False(pending)
+
+	statusc := make(chan string)
+	un2 := make(chan struct{})
+	go testLock("EX2", loc, un2, statusc)
+	t.Equal(<-statusc, "block EX2")
+	pending, err = s1.ExclusivePending()
+	t.Nil(err)
+	t.True(pending)
+
+	t.Nil(s1.UnlockErr())
+	t.Equal(<-statusc, "acquired EX2")
+	un2 <- struct{}{}
+}
+
 func TestNotInitialized(tt *testing.T) {
 	t := check.T(tt)
 
-	s, err := newStorage(loc)
+	s, err := newStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	defer s.Close()
 
 	t.PanicMatch(func() { s.SharedLock() }, `doesn't exist`)
-	s.tx.Rollback()
+	t.Nil(s.Tx())
 }
 
 func TestGet(tt *testing.T) {
 	t := check.T(tt)
 
-	v, err := newInitializedStorage(loc)
+	v, err := newInitializedStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	defer dropTable(t)
 	defer v.Close()
@@ -158,7 +233,7 @@ func TestGet(tt *testing.T) {
 func TestSet(tt *testing.T) {
 	t := check.T(tt)
 
-	v, err := newInitializedStorage(loc)
+	v, err := newInitializedStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	defer dropTable(t)
 	defer v.Close()
@@ -171,7 +246,7 @@ func TestSet(tt *testing.T) {
 func TestReconnect(tt *testing.T) {
 	t := check.T(tt)
 
-	v, err := newInitializedStorage(loc)
+	v, err := newInitializedStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	defer dropTable(t)
 	defer v.Close()
@@ -198,3 +273,103 @@ func TestReconnect(tt *testing.T) {
 	t.NotPanic(v.ExclusiveLock)
 	v.Unlock()
 }
+
+func TestPing(tt *testing.T) {
+	t := check.T(tt)
+
+	t.Nil(initialize(loc))
+	defer dropTable(t)
+
+	s, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s.Close()
+
+	restartProxy := func() {
+		proxy.Close()
+		t.Nil(internal.WaitTCPPortClosed(ctx, proxy.FrontendAddr()))
+		go func() {
+			var err error
+			time.Sleep(time.Second)
+			proxy, err = internal.NewTCPProxy(ctx, proxy.FrontendAddr().String(), proxy.BackendAddr().String())
+			t.Nil(err)
+		}()
+	}
+
+	t.Err(s.Ping(ctx), schemaver.ErrNotLocked)
+	t.Nil(s.SharedLockContext(ctx))
+	t.Nil(s.Ping(ctx))
+	restartProxy()
+	t.NotNil(s.Ping(ctx))
+	t.NotPanic(s.Unlock)
+}
+
+func TestNewWithDB(tt *testing.T) {
+	t := check.T(tt)
+
+	s, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s.Close()
+	defer dropTable(t)
+	s2, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s2.Close()
+
+	// - unix socket, error
+	_, err = NewWithDB(s.db, &mysql.Config{Net: "unix", Addr: "/tmp/mysql.sock"})
+	t.Err(err, errConfigRequireTCP)
+
+	// - not initialized, initialize
+	v, err := NewWithDB(s.db, &mysql.Config{Net: "tcp", Addr: loc.Host})
+	t.Nil(err)
+	t.True(s.initialized())
+	t.Contains(v.Location().String(), "@"+loc.Host+"/")
+
+	// - SH (using db), EX (using another pool) blocked, UN
+	t.Equal(v.SharedLock(), "none")
+	t.Err(s2.TryExclusiveLock(), schemaver.ErrWouldBlock)
+	v.Unlock()
+	t.Nil(s2.TryExclusiveLock())
+	t.Nil(s2.UnlockErr())
+
+	// - Close won't close db
+	t.Nil(v.Close())
+	t.Nil(s.db.Ping())
+}
+
+func TestToken(tt *testing.T) {
+	t := check.T(tt)
+
+	t.Nil(initialize(loc))
+	defer dropTable(t)
+
+	s1, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s1.Close()
+	s2, err := newStorage(loc, schemaver.Options{})
+	t.Nil(err)
+	defer s2.Close()
+
+	// - Token without lock, error
+	_, err = s1.Token()
+	t.Err(err, schemaver.ErrNotLocked)
+
+	// - EX, Token, Token (same)
+	t.Nil(s1.ExclusiveLockContext(ctx))
+	token, err := s1.Token()
+	t.Nil(err)
+	token2, err := s1.Token()
+	t.Nil(err)
+	t.Equal(token2, token)
+
+	// - VerifyToken: valid, invalid
+	t.Nil(s2.VerifyToken(token))
+	other, err := internal.NewToken()
+	t.Nil(err)
+	for _, token := range []string{"", "x", token + "0", other} {
+		t.Err(s2.VerifyToken(token), schemaver.ErrInvalidToken, token)
+	}
+
+	// - UN, VerifyToken: invalid
+	t.Nil(s1.UnlockErr())
+	t.Err(s2.VerifyToken(token), schemaver.ErrInvalidToken)
+}
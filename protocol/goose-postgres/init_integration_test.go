@@ -19,6 +19,7 @@ import (
 	"github.com/powerman/pqx"
 
 	"github.com/powerman/narada4d/internal"
+	"github.com/powerman/narada4d/schemaver"
 )
 
 const (
@@ -77,7 +78,7 @@ func env2query(env string) string { return url.QueryEscape(os.Getenv(env)) }
 
 func dropTable(t *check.C) {
 	t.Helper()
-	s, err := newStorage(loc)
+	s, err := newStorage(loc, schemaver.Options{})
 	t.Nil(err)
 	_, err = s.db.Exec(sqlDropTable)
 	t.Nil(err)
@@ -85,7 +86,7 @@ func dropTable(t *check.C) {
 }
 
 func testLock(name string, loc *url.URL, unlockc chan struct{}, statusc chan string) {
-	v, err := newStorage(loc)
+	v, err := newStorage(loc, schemaver.Options{})
 	if err != nil {
 		panic(err)
 	}
@@ -2,10 +2,17 @@
 package goosepostgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/lib/pq"
@@ -18,58 +25,144 @@ import (
 )
 
 const (
+	errCodeLockNotAvailable = "55P03"
+	defaultPort             = "5432"
+
+	sqlCurrent       = `SELECT current_user, current_database()`
 	sqlInitialized   = `SELECT COUNT(*) FROM goose_db_version`
 	sqlSharedLock    = `LOCK TABLE goose_db_version IN SHARE MODE`
 	sqlExclusiveLock = `LOCK TABLE goose_db_version IN SHARE UPDATE EXCLUSIVE MODE`
+	sqlNoWait        = ` NOWAIT`
+	sqlNotify        = `NOTIFY ` + notifyChannel
+
+	sqlExclusivePending = `
+SELECT COUNT(*) FROM pg_locks
+WHERE locktype='relation' AND relation='goose_db_version'::regclass AND NOT granted
+`
+	sqlTokenLock = `SELECT pg_try_advisory_xact_lock($1)`
+	sqlTokenHeld = `
+SELECT COUNT(*) FROM pg_locks
+WHERE locktype='advisory' AND granted AND objsubid=1 AND classid::bigint=$1 AND objid::bigint=$2
+  AND pid IN (SELECT pid FROM pg_locks WHERE locktype='relation'
+    AND relation='goose_db_version'::regclass AND mode='ShareUpdateExclusiveLock' AND granted)
+`
+
+	notifyChannel        = "narada4d"
+	minReconnectInterval = time.Second / 10
+	maxReconnectInterval = 10 * time.Second
 )
 
 var (
-	errAlreadyInitialized = errors.New("already initialized")
-	errLocked             = errors.New("locked")
+	errTokenLock      = errors.New("failed to acquire token lock")
+	errAddrRequireTCP = errors.New("require TCP address host[:port]")
 )
 
 type storage struct {
-	db    *sql.DB
-	tx    *sql.Tx
-	goose *goose.Instance
+	opts      schemaver.Options
+	dsn       string
+	db        *sql.DB
+	extDB     bool // Do not close db, it's owned by caller.
+	conn      *sql.Conn
+	tx        *sql.Tx
+	exclusive bool
+	token     string
+	goose     *goose.Instance
 }
 
 func init() {
 	schemaver.RegisterProtocol("goose-postgres", schemaver.Backend{
-		Initialize: initialize,
-		New:        newInitializedStorage,
+		Initialize:     initialize,
+		NewWithOptions: newInitializedStorage,
+		Canonical:      canonical,
 	})
 }
 
+// canonical adds default port, cleans path and removes connect_timeout query
+// param (it doesn't change location).
+func canonical(loc *url.URL) *url.URL {
+	loc.Host = internal.HostWithPort(loc.Host, defaultPort)
+	if loc.Path != "" {
+		loc.Path, loc.RawPath = path.Clean(loc.Path), ""
+	}
+	if q := loc.Query(); q.Get("connect_timeout") != "" {
+		q.Del("connect_timeout")
+		loc.RawQuery = q.Encode()
+	}
+	return loc
+}
+
 func initialize(loc *url.URL) error {
-	s, err := newStorage(loc)
+	s, err := newStorage(loc, schemaver.Options{})
 	if err != nil {
 		return err
 	}
 	defer s.Close() //nolint:errcheck // Defer.
 
 	if s.initialized() {
-		return errAlreadyInitialized
+		return schemaver.ErrAlreadyInitialized
 	}
 	return s.init()
 }
 
-func newInitializedStorage(loc *url.URL) (schemaver.Manage, error) {
-	s, err := newStorage(loc)
+func newInitializedStorage(loc *url.URL, opts schemaver.Options) (schemaver.Manage, error) {
+	s, err := newStorage(loc, opts)
 	if err != nil {
 		return nil, err
 	}
-	if !s.initialized() {
-		if err := s.init(); err != nil {
-			_ = s.Close()
-			return nil, err
-		}
+	if err := s.ensureInitialized(); err != nil {
+		_ = s.Close()
+		return nil, err
 	}
 	return s, nil
 }
 
-func newStorage(loc *url.URL) (*storage, error) {
+// NewWithDB creates object for managing data schema version in database
+// used by db instead of opening own connection pool.
+//
+// Will initialize version if it's not initialized yet.
+//
+// Lock pins a dedicated connection from db until unlock, so db pool
+// must allow one more connection per returned object (plus one more
+// while Watch is running). Closing returned object won't close db.
+//
+// Location used to identify version (see schemaver.EnvSkipLock) is
+// goose-postgres://user@host:port/database with addr (host[:port] of
+// TCP address used to open db, default port is 5432) and current user
+// and database.
+func NewWithDB(db *sql.DB, addr string, opts ...schemaver.Option) (*schemaver.SchemaVer, error) {
+	if addr == "" || strings.HasPrefix(addr, "/") {
+		return nil, errAddrRequireTCP
+	}
+	var user, database string
+	err := db.QueryRow(sqlCurrent).Scan(&user, &database)
+	if err != nil {
+		return nil, err
+	}
+	loc := &url.URL{Scheme: "goose-postgres", User: url.User(user), Host: addr, Path: "/" + database}
+	return schemaver.NewWithManage(loc.String(), func(opts schemaver.Options) (schemaver.Manage, error) {
+		s := &storage{
+			opts:  opts,
+			db:    db,
+			extDB: true,
+			goose: goose.NewInstance(),
+		}
+		err := s.goose.SetDialect("postgres")
+		if err == nil {
+			err = s.ensureInitialized()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, opts...)
+}
+
+func newStorage(loc *url.URL, opts schemaver.Options) (*storage, error) {
 	loc.Scheme = "postgres"
+	if q := loc.Query(); opts.DialTimeout != 0 && q.Get("connect_timeout") == "" {
+		q.Set("connect_timeout", strconv.Itoa(int(math.Ceil(opts.DialTimeout.Seconds()))))
+		loc.RawQuery = q.Encode()
+	}
 	db, err := sql.Open("pqx", loc.String())
 	if err != nil {
 		return nil, err
@@ -81,6 +174,8 @@ func newStorage(loc *url.URL) (*storage, error) {
 	}
 
 	s := &storage{
+		opts:  opts,
+		dsn:   loc.String(),
 		db:    db,
 		goose: goose.NewInstance(),
 	}
@@ -92,6 +187,13 @@ func newStorage(loc *url.URL) (*storage, error) {
 	return s, nil
 }
 
+func (s *storage) ensureInitialized() error {
+	if s.initialized() {
+		return nil
+	}
+	return s.init()
+}
+
 func (s *storage) initialized() bool {
 	var count int
 	_ = s.db.QueryRow(sqlInitialized).Scan(&count)
@@ -104,67 +206,258 @@ func (s *storage) init() error {
 }
 
 func (s *storage) SharedLock() {
+	must.PanicIf(s.SharedLockContext(context.Background()))
+}
+
+func (s *storage) ExclusiveLock() {
+	must.PanicIf(s.ExclusiveLockContext(context.Background()))
+}
+
+func (s *storage) SharedLockContext(ctx context.Context) error {
+	return s.lock(ctx, sqlSharedLock, false)
+}
+
+func (s *storage) ExclusiveLockContext(ctx context.Context) error {
+	return s.lock(ctx, sqlExclusiveLock, true)
+}
+
+// lock acquires lock and sets s.exclusive on success, transaction is
+// rolled back on error.
+func (s *storage) lock(ctx context.Context, sqlLock string, exclusive bool) error {
 	if s.tx != nil {
-		panic("already locked")
+		return schemaver.ErrLocked
 	}
 	op := func() (err error) {
-		s.tx, err = s.db.Begin()
+		err = s.begin(ctx)
 		if err == nil {
-			_, err = s.tx.Exec(sqlSharedLock)
+			_, err = s.tx.ExecContext(ctx, sqlLock)
+			if err != nil {
+				s.end()
+			}
 		}
 		if errors.As(err, new(*pq.Error)) { // Retry on network errors.
 			err = backoff.Permanent(err)
 		}
 		return err
 	}
-	must.PanicIf(backoff.Retry(op, internal.NewBackOff()))
+	err := backoff.RetryNotify(op, backoff.WithContext(s.opts.NewBackOff(), ctx), s.notify)
+	if err == nil {
+		s.exclusive = exclusive
+	}
+	return err
 }
 
-func (s *storage) ExclusiveLock() {
+func (s *storage) notify(err error, d time.Duration) {
+	s.opts.Logf("narada4d: goose-postgres: %v, retry in %v", err, d)
+}
+
+func (s *storage) TrySharedLock() error {
+	return s.tryLock(sqlSharedLock+sqlNoWait, false)
+}
+
+func (s *storage) TryExclusiveLock() error {
+	return s.tryLock(sqlExclusiveLock+sqlNoWait, true)
+}
+
+// tryLock works like lock but without waiting.
+func (s *storage) tryLock(sqlLock string, exclusive bool) error {
 	if s.tx != nil {
-		panic("already locked")
+		return schemaver.ErrLocked
 	}
-	op := func() (err error) {
-		s.tx, err = s.db.Begin()
-		if err == nil {
-			_, err = s.tx.Exec(sqlExclusiveLock)
-		}
-		if errors.As(err, new(*pq.Error)) { // Retry on network errors.
-			err = backoff.Permanent(err)
-		}
+	err := s.begin(context.Background())
+	if err != nil {
 		return err
 	}
-	must.PanicIf(backoff.Retry(op, internal.NewBackOff()))
+	_, err = s.tx.Exec(sqlLock)
+	if err != nil {
+		s.end()
+	} else {
+		s.exclusive = exclusive
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == errCodeLockNotAvailable {
+		err = schemaver.ErrWouldBlock
+	}
+	return err
+}
+
+// begin pins connection until end and starts transaction on it.
+// Transaction won't be affected by ctx.Done.
+func (s *storage) begin(ctx context.Context) (err error) {
+	s.conn, err = s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	s.tx, err = s.conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// end rollbacks transaction (if it wasn't committed) and releases
+// connection pinned by begin.
+func (s *storage) end() {
+	_ = s.tx.Rollback()
+	_ = s.conn.Close()
+	s.tx, s.conn, s.exclusive, s.token = nil, nil, false, ""
 }
 
 func (s *storage) Unlock() {
+	must.PanicIf(s.UnlockErr())
+}
+
+func (s *storage) UnlockErr() error {
 	if s.tx == nil {
-		panic("not locked")
+		return schemaver.ErrNotLocked
+	}
+	var err error
+	if s.exclusive { // Version may be changed, notify Watch.
+		_, err = s.tx.Exec(sqlNotify)
 	}
-	err := s.tx.Commit()
-	s.tx = nil
+	if err == nil {
+		err = s.tx.Commit()
+	}
+	s.end()
 	if err != nil && !errors.As(err, new(*pq.Error)) { // Ignore network errors.
 		err = nil
 	}
-	must.PanicIf(err)
+	return err
+}
+
+// ExclusivePending implements schemaver.ManagePending. Shared locks
+// never wait for each other, so any pending lock on goose_db_version
+// table means someone waits for exclusive lock.
+func (s *storage) ExclusivePending() (bool, error) {
+	var count int
+	err := s.db.QueryRow(sqlExclusivePending).Scan(&count)
+	return count > 0, err
+}
+
+// Ping implements schemaver.ManagePing. Lock is released by database
+// when connection used to acquire it is closed.
+func (s *storage) Ping(ctx context.Context) error {
+	if s.conn == nil {
+		return schemaver.ErrNotLocked
+	}
+	return s.conn.PingContext(ctx)
+}
+
+// Token implements schemaver.ManageToken. Token is a random key of
+// advisory lock acquired by transaction which holds exclusive lock,
+// it's released on unlock.
+func (s *storage) Token() (string, error) {
+	if !s.exclusive {
+		return "", schemaver.ErrNotLocked
+	}
+	if s.token == "" {
+		token, err := internal.NewToken()
+		if err != nil {
+			return "", err
+		}
+		key, _ := tokenKey(token)
+		var acquired bool
+		err = s.tx.QueryRow(sqlTokenLock, key).Scan(&acquired)
+		if err != nil {
+			return "", err
+		} else if !acquired {
+			return "", errTokenLock
+		}
+		s.token = token
+	}
+	return s.token, nil
+}
+
+// VerifyToken implements schemaver.ManageToken. Token is valid while
+// advisory lock with this key is held by transaction which also holds
+// exclusive lock.
+func (s *storage) VerifyToken(token string) error {
+	key, ok := tokenKey(token)
+	if !ok {
+		return fmt.Errorf("%w: %q", schemaver.ErrInvalidToken, token)
+	}
+	classID, objID := int64(uint64(key)>>32), int64(uint32(key))
+	var count int
+	err := s.db.QueryRow(sqlTokenHeld, classID, objID).Scan(&count)
+	if err == nil && count == 0 {
+		err = fmt.Errorf("%w: lock is not held", schemaver.ErrInvalidToken)
+	}
+	return err
+}
+
+// tokenKey returns advisory lock key for token.
+func tokenKey(token string) (int64, bool) {
+	buf, ok := internal.ParseToken(token)
+	if !ok {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(buf)), true
 }
 
 func (s *storage) Get() string {
-	v, err := goose.EnsureDBVersion(s.db)
+	ver, err := s.GetErr()
 	must.PanicIf(err)
+	return ver
+}
+
+func (s *storage) GetErr() (string, error) {
+	v, err := goose.EnsureDBVersion(s.db)
+	if err != nil {
+		return "", err
+	}
 	if v == 0 {
-		return "none"
+		return "none", nil
 	}
-	return strconv.Itoa(int(v))
+	return strconv.Itoa(int(v)), nil
+}
+
+func (s *storage) Set(ver string) {
+	must.PanicIf(s.SetErr(ver))
 }
 
-func (s *storage) Set(string) {
-	panic("not supported")
+func (s *storage) SetErr(string) error {
+	return schemaver.ErrNotSupported
+}
+
+// Watch implements schemaver.ManageWatch using LISTEN/NOTIFY. It's not
+// supported for storage created by NewWithDB because DSN is unknown.
+func (s *storage) Watch(ctx context.Context) (<-chan struct{}, error) {
+	if s.dsn == "" {
+		return nil, schemaver.ErrNotSupported
+	}
+	l := pq.NewListener(s.dsn, minReconnectInterval, maxReconnectInterval, nil)
+	err := l.Listen(notifyChannel)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	c := make(chan struct{}, 1)
+	go func() {
+		defer close(c)
+		defer l.Close() //nolint:errcheck // Defer.
+		for {
+			select {
+			case <-l.Notify: // Also receive nil after reconnect.
+				select {
+				case c <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
 }
 
 func (s *storage) Close() error {
 	if s.tx != nil {
-		return errLocked
+		return schemaver.ErrLocked
+	}
+	if s.extDB {
+		return nil
 	}
 	return s.db.Close()
 }
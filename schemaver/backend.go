@@ -1,8 +1,9 @@
 package schemaver
 
 import (
-	"fmt"
+	"context"
 	"net/url"
+	"sync"
 )
 
 // Backend used for registering backend implementing concrete protocol.
@@ -10,9 +11,18 @@ type Backend struct {
 	// New returns implementation of SchemaVerBackend working with
 	// version at given location or error if location is incorrect.
 	New func(*url.URL) (Manage, error)
+	// NewWithOptions may be set instead of New to get options used to
+	// create SchemaVer.
+	NewWithOptions func(*url.URL, Options) (Manage, error)
 	// Initialize version at given location or return error if
 	// location is incorrect or already initialized.
 	Initialize func(*url.URL) error
+	// Canonical is optional. It should return location in canonical
+	// form (e.g. with default port, cleaned path, resolved symlinks)
+	// to detect different locations of same data schema version (see
+	// EnvSkipLock). It's called with a copy of location (with lower
+	// case host) which may be modified and returned.
+	Canonical func(*url.URL) *url.URL
 }
 
 // Manage interface must be implemented by concrete data schema
@@ -41,16 +51,259 @@ type Manage interface {
 	Close() error
 }
 
-var registered = make(map[string]*Backend) //nolint:gochecknoglobals // Global state.
+// ManageContext may be implemented by Manage to support cancellation
+// of SharedLock and ExclusiveLock.
+//
+// Manage which doesn't implement ManageContext will be used through
+// adapter: on ctx.Done it'll stop waiting for lock and release lock
+// in background after it'll be acquired. Next lock and Close will wait
+// until such lock will be released.
+type ManageContext interface {
+	Manage
+	// SharedLockContext must acquire shared lock on version value
+	// or return error if ctx.Done before lock was acquired.
+	//
+	// If called with already acquired lock previous lock may be
+	// released before acquiring new one.
+	SharedLockContext(ctx context.Context) error
+	// ExclusiveLockContext must acquire exclusive lock on version
+	// value or return error if ctx.Done before lock was acquired.
+	//
+	// If called with already acquired lock previous lock may be
+	// released before acquiring new one.
+	ExclusiveLockContext(ctx context.Context) error
+}
+
+// ManageV2 may be implemented by Manage to return errors instead of
+// panics. Methods of Manage should be implemented as thin wrappers
+// which panics on errors returned by corresponding methods of ManageV2.
+//
+// Manage which doesn't implement ManageV2 will be used through adapter
+// which converts panics into errors matching ErrPanic.
+type ManageV2 interface {
+	ManageContext
+	// UnlockErr will be called after SharedLock or ExclusiveLock and
+	// must release lock on version value.
+	UnlockErr() error
+	// GetErr will be called after SharedLock or ExclusiveLock and must
+	// return current version.
+	GetErr() (string, error)
+	// SetErr will be called after ExclusiveLock and must change
+	// current version.
+	SetErr(string) error
+}
+
+// ManageTry may be implemented by Manage to support TrySharedLock and
+// TryExclusiveLock.
+type ManageTry interface {
+	// TrySharedLock must acquire shared lock on version value or
+	// return ErrWouldBlock if lock can't be acquired immediately.
+	TrySharedLock() error
+	// TryExclusiveLock must acquire exclusive lock on version value or
+	// return ErrWouldBlock if lock can't be acquired immediately.
+	TryExclusiveLock() error
+}
+
+// ManageDowngrade may be implemented by Manage to atomically convert
+// exclusive lock into shared lock.
+type ManageDowngrade interface {
+	// Downgrade will be called after ExclusiveLock and must convert it
+	// into shared lock without releasing it.
+	Downgrade() error
+}
+
+// ManageSetIf may be implemented by Manage to atomically change version
+// only if it has expected value.
+//
+// Manage which doesn't implement ManageSetIf will be used through
+// adapter which calls Get and then Set.
+type ManageSetIf interface {
+	// SetIf will be called after ExclusiveLock and must change current
+	// version only if it's equal to expected, otherwise it must
+	// return *VersionConflictError with current version.
+	SetIf(expected, ver string) error
+}
+
+// ManageNote may be implemented by Manage to store a note next to
+// version, it's used by Migrate to keep from/to of running or failed
+// migration while version is BadVersion.
+type ManageNote interface {
+	// Note will be called after SharedLock or ExclusiveLock and must
+	// return note set by SetNote or empty string if there is no note.
+	Note() (string, error)
+	// SetNote will be called after ExclusiveLock. Protocol may
+	// truncate long note.
+	SetNote(note string) error
+}
+
+// ManagePending may be implemented by Manage to let HoldSharedLockYield
+// release shared lock as soon as someone else waits for exclusive lock.
+type ManagePending interface {
+	// ExclusivePending will be called after SharedLock and must return
+	// true if someone else is waiting for exclusive lock. False
+	// positives are allowed but should be rare.
+	ExclusivePending() (bool, error)
+}
+
+// ManagePing may be implemented by Manage to detect lock was released
+// without calling Unlock (e.g. because connection to database was lost).
+type ManagePing interface {
+	// Ping will be called after SharedLock or ExclusiveLock (while
+	// lock is held) and must return error if lock is no longer held or
+	// this can't be checked before ctx.Done.
+	Ping(ctx context.Context) error
+}
+
+// ManageToken may be implemented by Manage to let child processes
+// verify lock listed in EnvSkipLock is really held by parent process.
+// Protocols which doesn't implement ManageToken trust EnvSkipLock.
+type ManageToken interface {
+	// Token will be called after ExclusiveLock and must return token
+	// (without spaces) which proves lock is held until Unlock or
+	// Downgrade. Token will be available to child processes.
+	Token() (string, error)
+	// VerifyToken will be called without lock (usually by child
+	// process) and must return error matching ErrInvalidToken if
+	// token wasn't returned by Token or lock is no longer held.
+	VerifyToken(token string) error
+}
+
+// ManageWatch may be implemented by Manage to notify Watch about
+// version changes instead of polling.
+type ManageWatch interface {
+	// Watch must return channel which will receive a value after each
+	// possible version change (notifications may be coalesced but
+	// must not be lost) or error if notifications are not available.
+	// Channel must be closed after ctx.Done or if notifications are
+	// no longer available.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
 
 // RegisterProtocol must be called by packages which implement some
-// protocol before first call to Initialize or New.
+// protocol before first call to Initialize or New. It registers
+// protocol in DefaultRegistry and panics on error.
 func RegisterProtocol(proto string, backend Backend) {
-	if registered[proto] != nil {
-		panic(fmt.Sprintf("protocol %q already registered", proto))
-	} else if backend.Initialize == nil || backend.New == nil {
-		panic(fmt.Sprintf("can't register protocol %q with nil implementation", proto))
+	if err := DefaultRegistry.Register(proto, backend); err != nil {
+		panic(err.Error())
+	}
+}
+
+func (b *Backend) new(loc *url.URL, opts Options) (Manage, error) {
+	if b.NewWithOptions != nil {
+		return b.NewWithOptions(loc, opts)
+	}
+	return b.New(loc)
+}
+
+type manageV2 struct {
+	ManageContext
+}
+
+func newManageV2(m Manage) ManageV2 {
+	if m2, ok := m.(ManageV2); ok {
+		return m2
+	}
+	return manageV2{ManageContext: newManageContext(m)}
+}
+
+func (m manageV2) SharedLockContext(ctx context.Context) (err error) {
+	defer recoverErr(&err)
+	return m.ManageContext.SharedLockContext(ctx)
+}
+
+func (m manageV2) ExclusiveLockContext(ctx context.Context) (err error) {
+	defer recoverErr(&err)
+	return m.ManageContext.ExclusiveLockContext(ctx)
+}
+
+func (m manageV2) UnlockErr() (err error) {
+	defer recoverErr(&err)
+	m.Unlock()
+	return nil
+}
+
+func (m manageV2) GetErr() (_ string, err error) {
+	defer recoverErr(&err)
+	return m.Get(), nil
+}
+
+func (m manageV2) SetErr(ver string) (err error) {
+	defer recoverErr(&err)
+	m.Set(ver)
+	return nil
+}
+
+type manageContext struct {
+	Manage
+	mu      sync.Mutex
+	pending chan struct{} // Closed after lock abandoned on ctx.Done was released.
+}
+
+func newManageContext(m Manage) ManageContext {
+	if mc, ok := m.(ManageContext); ok {
+		return mc
+	}
+	pending := make(chan struct{})
+	close(pending)
+	return &manageContext{Manage: m, pending: pending}
+}
+
+func (m *manageContext) SharedLockContext(ctx context.Context) error {
+	return m.lockContext(ctx, m.Manage.SharedLock)
+}
+
+func (m *manageContext) ExclusiveLockContext(ctx context.Context) error {
+	return m.lockContext(ctx, m.Manage.ExclusiveLock)
+}
+
+// Close waits until lock abandoned on ctx.Done will be released.
+func (m *manageContext) Close() error {
+	<-m.abandoned()
+	return m.Manage.Close()
+}
+
+func (m *manageContext) abandoned() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pending
+}
+
+func (m *manageContext) lockContext(ctx context.Context, lock func()) error {
+	select {
+	case <-m.abandoned():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+
+	done := make(chan interface{}, 1)
+	go func() {
+		defer func() { done <- recover() }()
+		lock()
+	}()
+
+	select {
+	case panicVal := <-done:
+		if panicVal != nil {
+			panic(panicVal)
+		}
+		return nil
+	case <-ctx.Done():
 	}
 
-	registered[proto] = &backend
+	pending := make(chan struct{})
+	m.mu.Lock()
+	m.pending = pending
+	m.mu.Unlock()
+	go func() {
+		defer close(pending)
+		defer func() { _ = recover() }() // Nobody is waiting for result.
+		if panicVal := <-done; panicVal == nil {
+			m.Manage.Unlock()
+		}
+	}()
+	return ctx.Err()
 }
@@ -0,0 +1,178 @@
+package schemaver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Policy defines how SharedLock and ExclusiveLock handle current version
+// which doesn't match constraint set by Require.
+type Policy int
+
+// Policies.
+const (
+	// PolicyFail will release lock and return *UnsupportedVersionError.
+	PolicyFail Policy = iota
+	// PolicyWait will release lock and try again later, until current
+	// version will match or ctx.Done. Recursive lock calls will work
+	// like PolicyFail because they can't release lock.
+	PolicyWait
+	// PolicyReport will keep lock and return current version with
+	// *UnsupportedVersionError (panicking methods won't panic).
+	PolicyReport
+)
+
+// Constraint describes a set of versions, it's defined using a small
+// language:
+//
+//	constraint = alternative { "||" alternative }
+//	alternative = term { " " term }
+//	term = [ "!" ] ( "none" | "dirty" )
+//	     | [ op ] numbered
+//	     | wildcard
+//	op = "=" | "!=" | "<" | "<=" | ">" | ">="
+//	wildcard = { digits "." } "x"
+//
+// Version matches constraint if it matches all terms of any
+// alternative. Terms with op and wildcard match only numbered
+// versions. Wildcard matches versions which starts with given
+// components (for ex. "1.2.x" matches "1.2", "1.2.0" and "1.2.3.4").
+// Empty constraint matches any version.
+//
+// Examples: ">=3 <5", "1.2.x", "!dirty", "none || >=2".
+type Constraint struct {
+	s    string
+	alts [][]term
+}
+
+type term struct {
+	op  string
+	ver Version
+}
+
+// ParseConstraint returns Constraint or error if s is not a valid
+// constraint.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{s: strings.TrimSpace(s)}
+	if c.s == "" {
+		return c, nil
+	}
+	for _, alt := range strings.Split(c.s, "||") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return Constraint{}, fmt.Errorf("%w: empty alternative in %q", ErrInvalidConstraint, s)
+		}
+		terms := make([]term, 0, len(fields))
+		for _, field := range fields {
+			t, err := parseTerm(field)
+			if err != nil {
+				return Constraint{}, fmt.Errorf("%w: %q in %q", ErrInvalidConstraint, field, s)
+			}
+			terms = append(terms, t)
+		}
+		c.alts = append(c.alts, terms)
+	}
+	return c, nil
+}
+
+var errInvalidTerm = errors.New("invalid term")
+
+func parseTerm(s string) (term, error) {
+	switch s {
+	case NoVersion, BadVersion, "!" + NoVersion, "!" + BadVersion:
+		t := term{op: "=", ver: Version(strings.TrimPrefix(s, "!"))}
+		if strings.HasPrefix(s, "!") {
+			t.op = "!="
+		}
+		return t, nil
+	}
+	if s == "x" || strings.HasSuffix(s, ".x") {
+		t := term{op: "x"}
+		if s != "x" {
+			var err error
+			t.ver, err = parseNumbered(strings.TrimSuffix(s, ".x"))
+			if err != nil {
+				return term{}, err
+			}
+		}
+		return t, nil
+	}
+	t := term{op: "="}
+	for _, op := range []string{"!=", "<=", ">=", "=", "<", ">"} {
+		if strings.HasPrefix(s, op) {
+			t.op = op
+			s = s[len(op):]
+			break
+		}
+	}
+	var err error
+	t.ver, err = parseNumbered(s)
+	return t, err
+}
+
+func parseNumbered(s string) (Version, error) {
+	ver, err := ParseVersion(s)
+	if err == nil && ver.rank() != rankNumbered {
+		err = errInvalidTerm
+	}
+	return ver, err
+}
+
+// String returns constraint in same format as it was parsed.
+func (c Constraint) String() string { return c.s }
+
+// Check returns true if ver matches constraint.
+func (c Constraint) Check(ver Version) bool {
+	if len(c.alts) == 0 {
+		return true
+	}
+	for _, alt := range c.alts {
+		match := true
+		for _, t := range alt {
+			match = match && t.check(ver)
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func (t term) check(ver Version) bool {
+	if t.ver.rank() != rankNumbered {
+		return (ver == t.ver) == (t.op == "=")
+	}
+	if ver.rank() != rankNumbered {
+		return false
+	}
+	switch t.op {
+	case "x":
+		return t.ver == "" || hasPrefix(ver, t.ver)
+	case "=":
+		return ver.Compare(t.ver) == 0
+	case "!=":
+		return ver.Compare(t.ver) != 0
+	case "<":
+		return ver.Compare(t.ver) < 0
+	case "<=":
+		return ver.Compare(t.ver) <= 0
+	case ">":
+		return ver.Compare(t.ver) > 0
+	case ">=":
+		return ver.Compare(t.ver) >= 0
+	default:
+		panic("never here")
+	}
+}
+
+// hasPrefix returns true if first components of ver are equal to
+// components of prefix.
+func hasPrefix(ver, prefix Version) bool {
+	n := strings.Count(string(prefix), ".") + 1
+	parts := strings.SplitN(string(ver), ".", n+1)
+	if len(parts) < n {
+		return false
+	}
+	return Version(strings.Join(parts[:n], ".")).Compare(prefix) == 0
+}
@@ -0,0 +1,92 @@
+package schemaver_test
+
+import (
+	"testing"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+func TestParseConstraint(tt *testing.T) {
+	t := check.T(tt)
+
+	cases := []struct {
+		s       string
+		wantErr bool
+	}{
+		{"", false},
+		{" ", false},
+		{"none", false},
+		{"!dirty", false},
+		{"42", false},
+		{"=1.2", false},
+		{"!=1.2", false},
+		{">=3 <5", false},
+		{"1.2.x", false},
+		{"x", false},
+		{"none || >=2", false},
+		{"||", true},
+		{"1 ||", true},
+		{"!", true},
+		{"!1", true},
+		{">=none", true},
+		{"<dirty", true},
+		{">=x", true},
+		{"x.1", true},
+		{"1.x.2", true},
+		{".x", true},
+		{"=>1", true},
+		{"~1", true},
+		{"v1", true},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.s, func(tt *testing.T) {
+			t := check.T(tt)
+			c, err := schemaver.ParseConstraint(tc.s)
+			if tc.wantErr {
+				t.Err(err, schemaver.ErrInvalidConstraint)
+				t.Equal(c.String(), "")
+			} else {
+				t.Nil(err)
+			}
+		})
+	}
+}
+
+func TestConstraintCheck(tt *testing.T) {
+	t := check.T(tt)
+
+	cases := []struct {
+		constraint string
+		match      []schemaver.Version
+		noMatch    []schemaver.Version
+	}{
+		{"", []schemaver.Version{"none", "dirty", "0", "1.2"}, nil},
+		{"none", []schemaver.Version{"none"}, []schemaver.Version{"dirty", "0"}},
+		{"!dirty", []schemaver.Version{"none", "0", "1.2"}, []schemaver.Version{"dirty"}},
+		{"1.2", []schemaver.Version{"1.2", "01.002"}, []schemaver.Version{"none", "1", "1.2.0"}},
+		{"!=1.2", []schemaver.Version{"1", "1.2.0"}, []schemaver.Version{"none", "dirty", "1.2"}},
+		{">=3 <5", []schemaver.Version{"3", "3.0", "4.99"}, []schemaver.Version{"none", "dirty", "2.9", "5", "5.0", "10"}},
+		{">0.9 <=0.12", []schemaver.Version{"0.10", "0.12"}, []schemaver.Version{"0.9", "0.12.0"}},
+		{"1.2.x", []schemaver.Version{"1.2", "1.2.0", "1.2.3.4", "01.2.3"}, []schemaver.Version{"none", "dirty", "1", "1.3", "1.20"}},
+		{"x", []schemaver.Version{"0", "1.2"}, []schemaver.Version{"none", "dirty"}},
+		{"none || >=2 !=3", []schemaver.Version{"none", "2", "4"}, []schemaver.Version{"dirty", "1", "3"}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.constraint, func(tt *testing.T) {
+			t := check.T(tt)
+			c, err := schemaver.ParseConstraint(tc.constraint)
+			t.Nil(err)
+			t.Equal(c.String(), tc.constraint)
+			for _, ver := range tc.match {
+				t.True(c.Check(ver), ver)
+			}
+			for _, ver := range tc.noMatch {
+				t.False(c.Check(ver), ver)
+			}
+		})
+	}
+}
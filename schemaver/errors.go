@@ -0,0 +1,101 @@
+package schemaver
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors.
+var (
+	ErrUnknownProtocol    = errors.New("narada4d: unknown protocol")
+	ErrAlreadyRegistered  = errors.New("already registered")
+	ErrAlreadyInitialized = errors.New("already initialized")
+	ErrInvalidVersion     = errors.New("invalid version value, require 'none' or 'dirty' or one or more digits separated with single dots")
+	ErrInvalidConstraint  = errors.New("invalid version constraint")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrNotLocked          = errors.New("no lock acquired")
+	ErrReleased           = errors.New("lock released")
+	ErrLocked             = errors.New("lock acquired")
+	ErrRequireExclusive   = errors.New("require ExclusiveLock")
+	ErrUnderSharedLock    = errors.New("unable to acquire exclusive lock under shared lock")
+	ErrNotSupported       = errors.New("not supported")
+	ErrWouldBlock         = errors.New("lock would block")
+	ErrPanic              = errors.New("backend panic")
+	ErrLockLost           = errors.New("lock lost")
+	ErrInvalidToken       = errors.New("invalid skip lock token")
+	ErrVersionConflict    = errors.New("version conflict")
+	ErrInvalidOption      = errors.New("invalid option")
+)
+
+type panicError struct{ val interface{} }
+
+func (e *panicError) Error() string        { return fmt.Sprintf("%s: %v", ErrPanic, e.val) }
+func (e *panicError) Is(target error) bool { return target == ErrPanic } //nolint:errorlint,goerr113 // Sentinel.
+func (e *panicError) Unwrap() error {
+	err, _ := e.val.(error)
+	return err
+}
+
+// recoverErr should be deferred to convert panic into error returned
+// by function.
+func recoverErr(err *error) {
+	if panicVal := recover(); panicVal != nil {
+		*err = &panicError{val: panicVal}
+	}
+}
+
+// UnsupportedVersionError is returned by SharedLock and ExclusiveLock
+// when current version doesn't match constraint set by Require.
+type UnsupportedVersionError struct {
+	Version    Version
+	Constraint Constraint
+	// LockHeld is true if lock was kept (see PolicyReport) and
+	// must be released by Unlock.
+	LockHeld bool
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("%s %q, require %q", ErrUnsupportedVersion, e.Version, e.Constraint)
+}
+
+// Is makes errors.Is(err, ErrUnsupportedVersion) works.
+func (e *UnsupportedVersionError) Is(target error) bool { return target == ErrUnsupportedVersion } //nolint:errorlint,goerr113 // Sentinel.
+
+// VersionConflictError is returned by SetIf when current version
+// doesn't match expected.
+type VersionConflictError struct {
+	Expected Version
+	Actual   Version
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%s: expected %q, actual %q", ErrVersionConflict, e.Expected, e.Actual)
+}
+
+// Is makes errors.Is(err, ErrVersionConflict) works.
+func (e *VersionConflictError) Is(target error) bool { return target == ErrVersionConflict } //nolint:errorlint,goerr113 // Sentinel.
+
+// MigrateError is returned by Migrate when version was left BadVersion.
+type MigrateError struct {
+	From  Version
+	To    Version
+	Err   error       // Returned by fn or protocol.
+	Panic interface{} // Value passed to panic by fn.
+	Stack []byte      // Stack trace of panic.
+}
+
+func (e *MigrateError) Error() string {
+	reason := fmt.Sprint(e.Err)
+	if e.Panic != nil {
+		reason = fmt.Sprintf("panic: %v", e.Panic)
+	}
+	return fmt.Sprintf("migration from %q to %q failed, version left %q: %s", e.From, e.To, BadVersion, reason)
+}
+
+// Unwrap returns Err or Panic if it's an error.
+func (e *MigrateError) Unwrap() error {
+	if err, ok := e.Panic.(error); ok {
+		return err
+	}
+	return e.Err
+}
@@ -0,0 +1,293 @@
+package schemaver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Holder controls goroutine started by HoldSharedLock.
+type Holder struct {
+	v           *SchemaVer
+	relockEvery time.Duration
+	checkEvery  time.Duration
+	cancel      context.CancelFunc
+	done        chan struct{}
+	errc        chan error
+	mu          sync.Mutex
+	paused      bool
+	pause       chan struct{} // Closed while paused.
+	busy        bool          // Lock is acquired or being acquired.
+	changed     chan struct{} // Closed and replaced on Resume and when busy become false.
+	locked      bool          // Lock was acquired at least once.
+	stats       HoldStats
+}
+
+// HoldStats contains Holder counters.
+type HoldStats struct {
+	Relocks  int           // Amount of times lock was released and acquired again.
+	WaitTime time.Duration // Total time spent waiting for lock.
+	HoldTime time.Duration // Total time lock was held.
+}
+
+// HoldSharedLock will start goroutine which will acquire shared lock
+// (just like Shared) and keep it until Close, ctx.Done or Stop. It'll
+// release and immediately re-acquire shared lock every relockEvery to
+// give someone else a chance to get ExclusiveLock. If shared lock fails
+// it'll retry after relockEvery.
+//
+// This is recommended optimization in case you've to do a lot of
+// short-living SharedLock every second.
+//
+// It may be called several times, returned holders are independent.
+func (v *SchemaVer) HoldSharedLock(ctx context.Context, relockEvery time.Duration) *Holder {
+	return v.hold(ctx, relockEvery, 0)
+}
+
+// HoldSharedLockYield works like HoldSharedLock but also releases
+// SharedLock as soon as someone else waits for ExclusiveLock, so
+// exclusive lock won't be delayed up to relockEvery. Waiters in other
+// goroutines are detected immediately, waiters in other processes are
+// detected every checkEvery if protocol supports this (see
+// ManagePending), otherwise it works like HoldSharedLock.
+func (v *SchemaVer) HoldSharedLockYield(ctx context.Context, relockEvery, checkEvery time.Duration) *Holder {
+	return v.hold(ctx, relockEvery, checkEvery)
+}
+
+func (v *SchemaVer) hold(ctx context.Context, relockEvery, checkEvery time.Duration) *Holder {
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = v.untilClose(ctx)
+	h := &Holder{
+		v:           v,
+		relockEvery: relockEvery,
+		checkEvery:  checkEvery,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		errc:        make(chan error, 1),
+		pause:       make(chan struct{}),
+		changed:     make(chan struct{}),
+	}
+	v.holdWG.Add(1)
+	go func() {
+		defer v.holdWG.Done()
+		h.run(ctx)
+	}()
+	return h
+}
+
+// Stop releases lock and stops holding it. It waits until lock will be
+// released. Next calls will do nothing.
+func (h *Holder) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+// Pause releases lock until Resume. It waits until lock will be
+// released (including interrupting attempt to acquire it).
+func (h *Holder) Pause() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.paused {
+		h.paused = true
+		close(h.pause)
+	}
+	for h.busy {
+		changed := h.changed
+		h.mu.Unlock()
+		select {
+		case <-changed:
+		case <-h.done:
+		}
+		h.mu.Lock()
+	}
+}
+
+// Resume continues holding lock after Pause.
+func (h *Holder) Resume() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.paused {
+		h.paused = false
+		h.pause = make(chan struct{})
+		h.broadcast()
+	}
+}
+
+// Err returns channel which will receive errors returned by Shared and
+// Release (including protocol panics, see ErrPanic). Errors will be
+// dropped if channel isn't read in time. Channel will be closed after
+// holding will be stopped.
+func (h *Holder) Err() <-chan error {
+	return h.errc
+}
+
+// Stats returns current counters.
+func (h *Holder) Stats() HoldStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// broadcast must be called under h.mu.
+func (h *Holder) broadcast() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *Holder) run(ctx context.Context) {
+	defer close(h.errc)
+	defer close(h.done)
+	for ctx.Err() == nil {
+		stop, ok := h.resumed(ctx)
+		if !ok {
+			return
+		}
+		locked, err := h.relock(ctx, stop)
+		if err != nil && ctx.Err() == nil {
+			select {
+			case h.errc <- err:
+			default:
+			}
+		}
+		if !locked {
+			select {
+			case <-time.After(h.relockEvery):
+			case <-stop:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// resumed waits until holder isn't paused and marks it busy. Returned
+// channel will be closed on Pause.
+func (h *Holder) resumed(ctx context.Context) (stop <-chan struct{}, ok bool) {
+	for {
+		h.mu.Lock()
+		paused, changed := h.paused, h.changed
+		if !paused {
+			h.busy = true
+			stop = h.pause
+		}
+		h.mu.Unlock()
+
+		if !paused {
+			return stop, true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// relock acquires shared lock and holds it until relockEvery, ctx.Done
+// or stop.
+func (h *Holder) relock(ctx context.Context, stop <-chan struct{}) (locked bool, err error) {
+	defer recoverErr(&err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wait, held time.Duration
+	defer h.finish(&locked, &wait, &held)
+
+	start := time.Now()
+	lock, err := h.v.Shared(ctx)
+	wait = time.Since(start)
+	if lock == nil {
+		if ctx.Err() != nil {
+			err = nil
+		}
+		return false, err
+	}
+	locked = true
+
+	start = time.Now()
+	defer func() {
+		errUnlock := lock.Release()
+		held = time.Since(start)
+		if err == nil {
+			err = errUnlock
+		}
+	}()
+	h.v.holdWait(ctx, h.relockEvery, h.checkEvery)
+	return true, err
+}
+
+// finish updates counters after relock and marks holder not busy.
+func (h *Holder) finish(locked *bool, wait, held *time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if *locked && h.locked {
+		h.stats.Relocks++
+	}
+	h.locked = h.locked || *locked
+	h.stats.WaitTime += *wait
+	h.stats.HoldTime += *held
+	h.busy = false
+	h.broadcast()
+}
+
+// holdWait returns after relockEvery, on ctx.Done or (if checkEvery > 0)
+// when someone else waits for ExclusiveLock.
+func (v *SchemaVer) holdWait(ctx context.Context, relockEvery, checkEvery time.Duration) {
+	relock := time.NewTimer(relockEvery)
+	defer relock.Stop()
+	var check <-chan time.Time
+	if _, ok := v.manage.(ManagePending); ok && checkEvery > 0 {
+		ticker := time.NewTicker(checkEvery)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		var released <-chan struct{}
+		if checkEvery > 0 {
+			v.mu.Lock()
+			if v.exclusiveWaiting > 0 {
+				v.mu.Unlock()
+				return
+			}
+			released = v.released
+			v.mu.Unlock()
+		}
+		select {
+		case <-relock.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-released:
+		case <-check:
+			if v.exclusivePending(ctx) {
+				return
+			}
+		}
+	}
+}
+
+func (v *SchemaVer) exclusivePending(ctx context.Context) bool {
+	if v.mu.LockContext(ctx) != nil {
+		return false
+	}
+	defer v.mu.Unlock()
+	if v.lockType != LockShared {
+		return false
+	}
+	pending, err := func() (_ bool, err error) {
+		defer recoverErr(&err)
+		return v.manage.(ManagePending).ExclusivePending()
+	}()
+	v.backendError(v.lockCtx, "ExclusivePending", err)
+	return err == nil && pending
+}
@@ -0,0 +1,96 @@
+package schemaver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+const redacted = "xxxxx"
+
+// Location of data schema version.
+//
+// It's safe to log or include in errors: String returns location
+// without secrets (password and query params like "password").
+type Location struct {
+	url       url.URL
+	canonical url.URL
+}
+
+func newLocation(loc *url.URL, backend *Backend) Location {
+	canonical := *loc
+	canonical.Host = strings.ToLower(canonical.Host)
+	if backend.Canonical != nil {
+		canonical = *backend.Canonical(&canonical)
+	}
+	return Location{url: *loc, canonical: canonical}
+}
+
+// Protocol returns protocol name (with alias replaced by protocol name).
+func (l Location) Protocol() string {
+	return l.url.Scheme
+}
+
+// String returns location with secrets replaced by "xxxxx".
+func (l Location) String() string {
+	u := l.url
+	if _, has := u.User.Password(); has {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for param := range q {
+			if isSecretParam(param) {
+				q.Set(param, redacted)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// ID returns stable identity of location which doesn't contain
+// secrets. It's used in EnvSkipLock.
+//
+// Locations with same ID differs only in secrets, fragment, order of
+// query params, host case or other details normalized by protocol (see
+// Backend.Canonical).
+func (l Location) ID() string {
+	u := l.canonical
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for param := range q {
+			if isSecretParam(param) {
+				q.Del(param)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	u.Fragment = ""
+	sum := sha256.Sum256([]byte(u.String()))
+	return l.url.Scheme + ":" + hex.EncodeToString(sum[:16])
+}
+
+// isLocationID returns true if s looks like a result of Location.ID.
+func isLocationID(s string) bool {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 || len(s)-i-1 != hex.EncodedLen(16) {
+		return false
+	}
+	_, err := hex.DecodeString(s[i+1:])
+	return err == nil
+}
+
+func isSecretParam(param string) bool {
+	param = strings.ToLower(param)
+	for _, secret := range []string{"pass", "secret", "token", "key"} {
+		if strings.Contains(param, secret) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package schemaver_test
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+func TestLocationRedacted(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	newLocation := func(location string) schemaver.Location {
+		t.Helper()
+		v, err := schemaver.NewAt(location)
+		t.Nil(err)
+		t.Nil(v.Close())
+		return v.Location()
+	}
+
+	cases := []struct {
+		location string
+		want     string
+	}{
+		{"test://", "test:"},
+		{"test:///path", "test:///path"},
+		{"test://user@/path", "test://user@/path"},
+		{"test://user:secret@/path", "test://user:xxxxx@/path"},
+		{"test:///path?a=1&password=secret", "test:///path?a=1&password=xxxxx"},
+		{"test:///path?sslkey=secret&Access_Token=secret", "test:///path?Access_Token=xxxxx&sslkey=xxxxx"},
+	}
+	for _, v := range cases {
+		loc := newLocation(v.location)
+		t.Equal(loc.Protocol(), "test", v.location)
+		t.Equal(loc.String(), v.want, v.location)
+		t.NotContains(loc.ID(), "secret", v.location)
+		t.HasPrefix(loc.ID(), "test:", v.location)
+	}
+
+	// - same ID: differs in secrets, fragment, params order
+	t.Equal(newLocation("test://user:secret@/path?a=1&b=2&password=secret").ID(),
+		newLocation("test://user@/path?b=2&a=1#frag").ID())
+	// - different ID: differs in user, path, params
+	id := newLocation("test://user@/path?a=1").ID()
+	t.NotEqual(newLocation("test://user2@/path?a=1").ID(), id)
+	t.NotEqual(newLocation("test://user@/path2?a=1").ID(), id)
+	t.NotEqual(newLocation("test://user@/path?a=2").ID(), id)
+	t.NotEqual(newLocation("test-basic://user@/path?a=1").ID(), id)
+
+	// - invalid location, error without secrets
+	_, err := schemaver.NewAt("test://user:secret@/path%zz")
+	t.NotNil(err)
+	t.NotContains(err.Error(), "secret")
+}
+
+func TestLocationSkipLock(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.NewAt("test://user:secret@/path")
+	t.Nil(err)
+	defer v.Close()
+	v2, err := schemaver.NewAt("test://user@/path2")
+	t.Nil(err)
+	defer v2.Close()
+
+	// - EX, EnvSkipLock contains ID without secrets, UN
+	v.ExclusiveLock()
+	env := os.Getenv(schemaver.EnvSkipLock)
+	t.Equal(env, v.Location().ID())
+	v2.ExclusiveLock()
+	t.Equal(os.Getenv(schemaver.EnvSkipLock), env+" "+v2.Location().ID())
+	t.NotContains(os.Getenv(schemaver.EnvSkipLock), "secret")
+	v.Unlock()
+	t.Equal(os.Getenv(schemaver.EnvSkipLock), v2.Location().ID())
+	v2.Unlock()
+	t.Equal(os.Getenv(schemaver.EnvSkipLock), "")
+
+	// - EnvSkipLock with ID or location (set by older version): inherited lock
+	for _, env := range []string{
+		v.Location().ID(),
+		"test://user:other@/path",
+		"unknown:0123456789abcdef0123456789abcdef " + v.Location().ID(),
+	} {
+		os.Setenv(schemaver.EnvSkipLock, env)
+		v3, err := schemaver.NewAt("test://user:secret@/path")
+		t.Nil(err)
+		t.Equal(v3.SharedLock(), "42")
+		v3.Unlock()
+		t.Nil(v3.Close())
+	}
+	mu.Lock()
+	t.Zero(sh)
+	mu.Unlock()
+
+	// - EnvSkipLock with ID of another protocol first: no legacy skip
+	os.Setenv(schemaver.EnvSkipLock, "unknown:0123456789abcdef0123456789abcdef")
+	v3, err := schemaver.NewAt("test://user:secret@/path")
+	t.Nil(err)
+	defer v3.Close()
+	t.Equal(v3.SharedLock(), "42")
+	v3.Unlock()
+	mu.Lock()
+	t.Equal(sh, 1)
+	mu.Unlock()
+}
+
+func TestLocationCanonical(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	var r schemaver.Registry
+	t.Nil(r.Register("canon", schemaver.Backend{
+		New:        func(*url.URL) (schemaver.Manage, error) { return &mockManage{}, nil },
+		Initialize: mockInitialize,
+		Canonical: func(loc *url.URL) *url.URL {
+			loc.Path = strings.TrimSuffix(loc.Path, "/")
+			return loc
+		},
+	}))
+	newLocation := func(location string) schemaver.Location {
+		t.Helper()
+		v, err := r.NewAt(location)
+		t.Nil(err)
+		t.Nil(v.Close())
+		return v.Location()
+	}
+
+	// - same ID: host case, canonical path
+	loc := newLocation("canon://Host/path/")
+	t.Equal(loc.String(), "canon://Host/path/")
+	t.Equal(loc.ID(), newLocation("canon://host/path").ID())
+	t.NotEqual(loc.ID(), newLocation("canon://host/path2").ID())
+
+	// - EnvSkipLock with location (set by older version) in another form
+	os.Setenv(schemaver.EnvSkipLock, "canon://HOST/path")
+	v, err := r.NewAt("canon://host/path/")
+	t.Nil(err)
+	defer v.Close()
+	t.Equal(v.SharedLock(), "42")
+	v.Unlock()
+	mu.Lock()
+	t.Zero(sh)
+	mu.Unlock()
+}
@@ -0,0 +1,102 @@
+package schemaver
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// Migrate acquires exclusive lock, checks current version is from, sets
+// version to BadVersion, runs fn and sets version to `to` if fn
+// succeeded. Lock is released before return.
+//
+// If current version isn't from then it returns *VersionConflictError
+// without running fn. If fn returns error or panics (or version can't
+// be set to `to`) then version is left BadVersion and *MigrateError is
+// returned. Both start of migration and *MigrateError are saved as a
+// note (if protocol supports it, see Note) and logged (if
+// Options.Logger is set), so from/to of interrupted migration (e.g. if
+// process was killed) can be found to help diagnose why data schema is
+// dirty.
+//
+// Constraint set by Require is ignored by Migrate. Just like Exclusive
+// it must not be called while same goroutine holds a lock. Exclusive
+// lock is held while fn runs, so fn will deadlock if it'll try to
+// acquire lock on same SchemaVer (e.g. using SharedLock or
+// ExclusiveLock).
+func (v *SchemaVer) Migrate(ctx context.Context, from, to Version, fn func(context.Context) error) (err error) {
+	if _, err = ParseVersion(string(to)); err != nil {
+		return err
+	}
+
+	ver, err := v.lockContext(ctx, lockRequest{
+		typ:          LockExclusive,
+		noConstraint: true,
+		lockBackend:  v.backend.ExclusiveLockContext,
+	})
+	if err != nil {
+		return err
+	}
+	lock := &Lock{v: v, typ: LockExclusive, ver: Version(ver)}
+	defer func() {
+		if errRelease := lock.Release(); err == nil {
+			err = errRelease
+		}
+	}()
+	return lock.Migrate(ctx, from, to, fn)
+}
+
+// Migrate works like SchemaVer.Migrate but uses already acquired
+// exclusive lock (which won't be released), so several migrations may
+// be done without releasing lock in between. It returns ErrReleased if
+// lock was already released.
+func (l *Lock) Migrate(ctx context.Context, from, to Version, fn func(context.Context) error) error {
+	if l.typ != LockExclusive {
+		return ErrRequireExclusive
+	}
+	if l.isReleased() {
+		return ErrReleased
+	}
+	if _, err := ParseVersion(string(to)); err != nil {
+		return err
+	}
+	v := l.v
+
+	err := v.setNote(fmt.Sprintf("migrating from %q to %q", from, to))
+	if err != nil {
+		return err
+	}
+	err = v.SetIf(from, BadVersion)
+	if err != nil {
+		return err
+	}
+	v.opts.Logf("narada4d: %s: migrating from %q to %q, version set to %q", v.loc, from, to, BadVersion)
+
+	migrateErr := &MigrateError{From: from, To: to}
+	migrateErr.Err = func() error {
+		defer func() {
+			if panicVal := recover(); panicVal != nil {
+				migrateErr.Panic = panicVal
+				migrateErr.Stack = debug.Stack()
+			}
+		}()
+		return fn(ctx)
+	}()
+	if migrateErr.Err == nil && migrateErr.Panic == nil {
+		migrateErr.Err = v.SetIf(BadVersion, to)
+		if migrateErr.Err == nil {
+			return nil
+		}
+	}
+	if err := v.setNote(migrateErr.Error()); err != nil {
+		v.opts.Logf("narada4d: %s: failed to set note: %v", v.loc, err)
+	}
+	v.opts.Logf("narada4d: %s: %v", v.loc, migrateErr)
+	return migrateErr
+}
+
+func (l *Lock) isReleased() bool {
+	l.v.mu.Lock()
+	defer l.v.mu.Unlock()
+	return l.released
+}
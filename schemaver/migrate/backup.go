@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+var (
+	errNoCommand  = errors.New("no command")
+	errNoBackupID = errors.New("no backup ID in output")
+)
+
+// Backup creates and restores backups of data. Both methods are called
+// under exclusive lock, which is inherited by child processes (see
+// schemaver.EnvSkipLock), so backup may be done by external tool which
+// uses Narada4D. Some protocols (e.g. mysql) do not let child process
+// access version, so such tool must not access it (and data used to
+// store it, e.g. Narada4D table).
+type Backup interface {
+	// Backup must create backup of data with given version and return
+	// it's ID (e.g. file name).
+	Backup(ctx context.Context, ver schemaver.Version) (id string, err error)
+	// Restore must replace data with backup returned by Backup.
+	Restore(ctx context.Context, id string) error
+}
+
+// CommandBackup implements Backup by running external commands.
+type CommandBackup struct {
+	// BackupCmd is executed with version as last arg and must print
+	// backup ID (e.g. file name) to stdout.
+	BackupCmd []string
+	// RestoreCmd is executed with backup ID as last arg.
+	RestoreCmd []string
+}
+
+// Backup implements Backup.
+func (b CommandBackup) Backup(ctx context.Context, ver schemaver.Version) (string, error) {
+	var stdout bytes.Buffer
+	err := b.run(ctx, &stdout, b.BackupCmd, string(ver))
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(stdout.String())
+	if id == "" {
+		return "", fmt.Errorf("%w of %q", errNoBackupID, b.BackupCmd[0])
+	}
+	return id, nil
+}
+
+// Restore implements Backup.
+func (b CommandBackup) Restore(ctx context.Context, id string) error {
+	return b.run(ctx, os.Stdout, b.RestoreCmd, id)
+}
+
+func (CommandBackup) run(ctx context.Context, stdout io.Writer, args []string, arg string) error {
+	if len(args) == 0 {
+		return errNoCommand
+	}
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:len(args):len(args)], arg)...) //nolint:gosec // By design.
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// RolledBackError is returned by RunWithBackup when migration has failed
+// but data and version were restored from backup.
+type RolledBackError struct {
+	Version  schemaver.Version // Restored version.
+	BackupID string
+	Err      error // Migration error.
+}
+
+func (e *RolledBackError) Error() string {
+	return fmt.Sprintf("rolled back to %q using backup %q after: %v", e.Version, e.BackupID, e.Err)
+}
+
+// Unwrap returns migration error.
+func (e *RolledBackError) Unwrap() error { return e.Err }
+
+// RunWithBackup works like Run but creates backup (if there is
+// something to migrate) before first step and restores it (using
+// schemaver.Lock.Migrate from schemaver.BadVersion to version at the
+// moment of backup) if some step fails. It won't migrate if backup
+// fails.
+//
+// Restore isn't interrupted by ctx.Done. If data was restored it
+// returns *RolledBackError.
+func (m *Migrations) RunWithBackup(ctx context.Context, v *schemaver.SchemaVer, to schemaver.Version, b Backup) error {
+	return m.run(ctx, v, to, b)
+}
+
+func (m *Migrations) run(ctx context.Context, v *schemaver.SchemaVer, to schemaver.Version, b Backup) (err error) {
+	lock, err := v.Exclusive(ctx)
+	if lock == nil {
+		return err
+	}
+	defer func() {
+		if errRelease := lock.Release(); err == nil {
+			err = errRelease
+		}
+	}()
+
+	from := lock.Version()
+	steps, err := m.Path(from, to)
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	var id string
+	if b != nil {
+		id, err = b.Backup(ctx, from)
+		if err != nil {
+			return fmt.Errorf("%w of version %q: %v", ErrBackup, from, err)
+		}
+	}
+
+	for _, step := range steps {
+		err = lock.Migrate(ctx, step.From, step.To, step.Func)
+		if err != nil {
+			break
+		}
+	}
+	var migrateErr *schemaver.MigrateError
+	if b == nil || !errors.As(err, &migrateErr) {
+		return err
+	}
+
+	errRestore := lock.Migrate(withoutCancel{ctx}, schemaver.BadVersion, from, func(ctx context.Context) error {
+		return b.Restore(ctx, id)
+	})
+	if errRestore != nil {
+		return fmt.Errorf("%w, failed to restore backup %q: %v", err, id, errRestore)
+	}
+	return &RolledBackError{Version: from, BackupID: id, Err: err}
+}
+
+// withoutCancel is a context which is never done.
+type withoutCancel struct{ context.Context } //nolint:containedctx // By design.
+
+func (withoutCancel) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutCancel) Done() <-chan struct{}       { return nil }
+func (withoutCancel) Err() error                  { return nil }
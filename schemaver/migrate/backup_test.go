@@ -0,0 +1,134 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+	"github.com/powerman/narada4d/schemaver/migrate"
+)
+
+var errBackup = errors.New("backup error")
+
+type mockBackup struct {
+	backups    []schemaver.Version
+	restores   []string
+	errBackup  error
+	errRestore error
+}
+
+func (b *mockBackup) Backup(_ context.Context, ver schemaver.Version) (string, error) {
+	b.backups = append(b.backups, ver)
+	return "backup-" + string(ver), b.errBackup
+}
+
+func (b *mockBackup) Restore(_ context.Context, id string) error {
+	b.restores = append(b.restores, id)
+	return b.errRestore
+}
+
+func TestRunWithBackup(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer os.RemoveAll(tempdir)
+	v, err := schemaver.NewAt("file://" + tempdir)
+	t.Nil(err)
+	defer v.Close()
+	get := func() string {
+		v.SharedLock()
+		defer v.Unlock()
+		return v.Get()
+	}
+
+	noop := func(context.Context) error { return nil }
+	var m migrate.Migrations
+	t.Nil(m.Register("1", noop, nil))
+	t.Nil(m.Register("2", noop, nil))
+	t.Nil(m.Register("3", func(context.Context) error { return errMigrate }, nil))
+
+	// - success, backup of initial version
+	b := &mockBackup{}
+	t.Nil(m.RunWithBackup(ctx, v, "1", b))
+	t.DeepEqual(b.backups, []schemaver.Version{schemaver.NoVersion})
+	t.Nil(b.restores)
+	t.Equal(get(), "1")
+
+	// - nothing to migrate, no backup
+	b = &mockBackup{}
+	t.Nil(m.RunWithBackup(ctx, v, "1", b))
+	t.Nil(b.backups)
+
+	// - backup failed, no migration
+	b = &mockBackup{errBackup: errBackup}
+	err = m.RunWithBackup(ctx, v, "2", b)
+	t.Err(err, migrate.ErrBackup)
+	t.Match(err, `backup error`)
+	t.Equal(get(), "1")
+
+	// - step failed, restored
+	b = &mockBackup{}
+	err = m.RunWithBackup(ctx, v, "3", b)
+	var rolledBackErr *migrate.RolledBackError
+	t.True(errors.As(err, &rolledBackErr))
+	t.Equal(rolledBackErr.Version, schemaver.Version("1"))
+	t.Equal(rolledBackErr.BackupID, "backup-1")
+	t.True(errors.Is(err, errMigrate))
+	t.DeepEqual(b.restores, []string{"backup-1"})
+	t.Equal(get(), "1")
+
+	// - step failed, restore failed, dirty
+	b = &mockBackup{errRestore: errBackup}
+	err = m.RunWithBackup(ctx, v, "3", b)
+	t.False(errors.As(err, &rolledBackErr))
+	t.True(errors.Is(err, errMigrate))
+	t.Match(err, `failed to restore backup "backup-1": .*: backup error$`)
+	t.Equal(get(), schemaver.BadVersion)
+}
+
+func TestCommandBackup(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer os.RemoveAll(tempdir)
+	v, err := schemaver.NewAt("file://" + tempdir)
+	t.Nil(err)
+	defer v.Close()
+	restored := filepath.Join(tempdir, "restored")
+
+	var m migrate.Migrations
+	t.Nil(m.Register("1", func(context.Context) error { return errMigrate }, nil))
+
+	// Commands must run under inherited lock.
+	b := migrate.CommandBackup{
+		BackupCmd:  []string{"sh", "-c", `test -n "$NARADA4D_SKIP_LOCK" && echo "backup-$1"`, "sh"},
+		RestoreCmd: []string{"sh", "-c", `test -n "$NARADA4D_SKIP_LOCK" && echo "$1" >"$0"`, restored},
+	}
+	err = m.RunWithBackup(ctx, v, "1", b)
+	var rolledBackErr *migrate.RolledBackError
+	t.True(errors.As(err, &rolledBackErr))
+	t.Equal(rolledBackErr.BackupID, "backup-none")
+	buf, err := ioutil.ReadFile(restored)
+	t.Nil(err)
+	t.Equal(string(buf), "backup-none\n")
+
+	// - no backup ID, error
+	b.BackupCmd = []string{"true"}
+	err = m.RunWithBackup(ctx, v, "1", b)
+	t.Err(err, migrate.ErrBackup)
+	t.Match(err, `no backup ID in output of "true"`)
+
+	// - no command, error
+	err = m.RunWithBackup(ctx, v, "1", migrate.CommandBackup{})
+	t.Match(err, `backup failed .*no command`)
+}
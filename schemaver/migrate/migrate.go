@@ -0,0 +1,274 @@
+// Package migrate provides migration runner which works with data
+// schema version managed by any schemaver protocol.
+//
+// Application registers migration for each version (up from previous
+// version and optional down to previous version), and Run finds path
+// from current to target version and runs it under exclusive lock.
+//
+// It works with any protocol which supports schemaver.SchemaVer.Set
+// (goose-* protocols doesn't, they use goose to run migrations).
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+// Errors.
+var (
+	ErrDirty          = errors.New("version is dirty")
+	ErrUnknownVersion = errors.New("no migration for version")
+	ErrIrreversible   = errors.New("no down migration")
+
+	ErrSQLFileName        = errors.New("invalid migration file name, require NNN_name.up.sql or NNN_name.down.sql")
+	ErrSingleStatement    = errors.New("require exactly one statement per migration file")
+	ErrNoUpMigration      = errors.New("no up migration file")
+	ErrDuplicateMigration = errors.New("duplicate migration file")
+	ErrBackup             = errors.New("backup failed")
+)
+
+// Func migrates data schema.
+type Func func(ctx context.Context) error
+
+// Direction of migration step.
+type Direction int
+
+// Directions.
+const (
+	Up Direction = iota + 1
+	Down
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Up:
+		return "up"
+	case Down:
+		return "down"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// Step is a single migration between adjacent versions.
+type Step struct {
+	Direction Direction
+	From      schemaver.Version
+	To        schemaver.Version // Resulting version.
+	Func      Func
+	// Transactional is true if Func won't change data on failure
+	// (see RegisterTx).
+	Transactional bool
+}
+
+// String returns step description like "up 1 -> 2 (transactional)".
+func (s Step) String() string {
+	tx := "non-transactional"
+	if s.Transactional {
+		tx = "transactional"
+	}
+	return fmt.Sprintf("%s %s -> %s (%s)", s.Direction, s.From, s.To, tx)
+}
+
+// Plan contains steps needed to migrate from one version to another.
+type Plan struct {
+	From  schemaver.Version
+	To    schemaver.Version
+	Steps []Step
+}
+
+// Migrations contains migrations ordered by version.
+//
+// The zero value is an empty set of migrations ready to use. It's safe
+// for concurrent use.
+type Migrations struct {
+	mu         sync.RWMutex
+	migrations []migration
+}
+
+type migration struct {
+	ver    schemaver.Version
+	up     Func
+	down   Func
+	upTx   bool
+	downTx bool
+}
+
+// Register adds migration up from previous registered version (or
+// schemaver.NoVersion) to ver and optional migration down from ver to
+// previous version. Migrations may be registered in any order.
+func (m *Migrations) Register(ver schemaver.Version, up, down Func) error {
+	return m.register(migration{ver: ver, up: up, down: down})
+}
+
+// RegisterTx works like Register for transactional migration, which
+// won't change data on failure (e.g. runs in a transaction and doesn't
+// contain statements which cause an implicit commit). It's used only to
+// report Step.Transactional.
+func (m *Migrations) RegisterTx(ver schemaver.Version, up, down Func) error {
+	return m.register(migration{ver: ver, up: up, down: down, upTx: true, downTx: true})
+}
+
+func (m *Migrations) register(mig migration) error {
+	ver := mig.ver
+	if _, err := schemaver.ParseVersion(string(ver)); err != nil {
+		return err
+	} else if ver.IsNone() || ver.IsDirty() {
+		return fmt.Errorf("can't register migration to %q: %w", ver, schemaver.ErrInvalidVersion)
+	} else if mig.up == nil {
+		return fmt.Errorf("can't register migration to %q with nil up", ver) //nolint:goerr113 // Programming error.
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.search(ver)
+	if i < len(m.migrations) && m.migrations[i].ver.Compare(ver) == 0 {
+		return fmt.Errorf("migration to %q %w", ver, schemaver.ErrAlreadyRegistered)
+	}
+	m.migrations = append(m.migrations, migration{})
+	copy(m.migrations[i+1:], m.migrations[i:])
+	m.migrations[i] = mig
+	return nil
+}
+
+// Versions returns registered versions in ascending order.
+func (m *Migrations) Versions() []schemaver.Version {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vers := make([]schemaver.Version, len(m.migrations))
+	for i := range m.migrations {
+		vers[i] = m.migrations[i].ver
+	}
+	return vers
+}
+
+// Latest returns latest registered version or schemaver.NoVersion.
+func (m *Migrations) Latest() schemaver.Version {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.migrations) == 0 {
+		return schemaver.NoVersion
+	}
+	return m.migrations[len(m.migrations)-1].ver
+}
+
+// Path returns steps needed to migrate from one version to another.
+// Both versions must be either registered or schemaver.NoVersion.
+//
+// It returns error matching ErrDirty if from is schemaver.BadVersion,
+// ErrUnknownVersion if version is not registered and ErrIrreversible
+// if some of required down migrations is nil.
+func (m *Migrations) Path(from, to schemaver.Version) ([]Step, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if from.IsDirty() {
+		return nil, fmt.Errorf("can't migrate from %q: %w", from, ErrDirty)
+	}
+	fromIdx, err := m.index(from)
+	if err != nil {
+		return nil, err
+	}
+	toIdx, err := m.index(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+	for i := fromIdx + 1; i <= toIdx; i++ {
+		steps = append(steps, Step{
+			Direction:     Up,
+			From:          m.prev(i),
+			To:            m.migrations[i].ver,
+			Func:          m.migrations[i].up,
+			Transactional: m.migrations[i].upTx,
+		})
+	}
+	for i := fromIdx; i > toIdx; i-- {
+		if m.migrations[i].down == nil {
+			return nil, fmt.Errorf("%w from %q", ErrIrreversible, m.migrations[i].ver)
+		}
+		steps = append(steps, Step{
+			Direction:     Down,
+			From:          m.migrations[i].ver,
+			To:            m.prev(i),
+			Func:          m.migrations[i].down,
+			Transactional: m.migrations[i].downTx,
+		})
+	}
+	return steps, nil
+}
+
+// Run acquires exclusive lock, migrates from current version to given
+// version and releases lock. Each step is done using
+// schemaver.Lock.Migrate, so version will be left schemaver.BadVersion
+// if step fails.
+//
+// Constraint set by v.Require is checked while acquiring lock, so it
+// should be either not set or use schemaver.PolicyReport.
+func (m *Migrations) Run(ctx context.Context, v *schemaver.SchemaVer, to schemaver.Version) error {
+	return m.run(ctx, v, to, nil)
+}
+
+// Plan acquires shared lock, gets current version and returns steps
+// needed to migrate to given version (dry run). It doesn't change data
+// or version. Run may do other steps if version will be changed by
+// someone else in between.
+//
+// Constraint set by v.Require is checked just like in Run.
+func (m *Migrations) Plan(ctx context.Context, v *schemaver.SchemaVer, to schemaver.Version) (_ *Plan, err error) {
+	lock, err := v.Shared(ctx)
+	if lock == nil {
+		return nil, err
+	}
+	defer func() {
+		if errRelease := lock.Release(); err == nil {
+			err = errRelease
+		}
+	}()
+
+	from, err := v.GetErr()
+	if err != nil {
+		return nil, err
+	}
+	steps, err := m.Path(schemaver.Version(from), to)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{From: schemaver.Version(from), To: to, Steps: steps}, nil
+}
+
+// search must be called under m.mu.
+func (m *Migrations) search(ver schemaver.Version) int {
+	return sort.Search(len(m.migrations), func(i int) bool {
+		return m.migrations[i].ver.Compare(ver) >= 0
+	})
+}
+
+// index must be called under m.mu. It returns -1 for NoVersion.
+func (m *Migrations) index(ver schemaver.Version) (int, error) {
+	if ver.IsNone() {
+		return -1, nil
+	}
+	i := m.search(ver)
+	if i == len(m.migrations) || m.migrations[i].ver.Compare(ver) != 0 {
+		return 0, fmt.Errorf("%w %q", ErrUnknownVersion, ver)
+	}
+	return i, nil
+}
+
+// prev must be called under m.mu.
+func (m *Migrations) prev(i int) schemaver.Version {
+	if i == 0 {
+		return schemaver.NoVersion
+	}
+	return m.migrations[i-1].ver
+}
@@ -0,0 +1,200 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+
+	_ "github.com/powerman/narada4d/protocol/file"
+	"github.com/powerman/narada4d/schemaver"
+	"github.com/powerman/narada4d/schemaver/migrate"
+)
+
+var errMigrate = errors.New("migrate failed")
+
+func TestRegister(tt *testing.T) {
+	t := check.T(tt)
+	noop := func(context.Context) error { return nil }
+
+	var m migrate.Migrations
+	t.Equal(m.Latest(), schemaver.Version(schemaver.NoVersion))
+	t.Nil(m.Register("2", noop, nil))
+	t.Nil(m.Register("1", noop, noop))
+	t.Nil(m.Register("1.1", noop, noop))
+	t.Nil(m.Register("10", noop, noop))
+
+	t.Err(m.Register("v3", noop, nil), schemaver.ErrInvalidVersion)
+	t.True(errors.Is(m.Register(schemaver.NoVersion, noop, nil), schemaver.ErrInvalidVersion))
+	t.True(errors.Is(m.Register(schemaver.BadVersion, noop, nil), schemaver.ErrInvalidVersion))
+	t.Match(m.Register("3", nil, nil), `nil up`)
+	t.True(errors.Is(m.Register("2", noop, nil), schemaver.ErrAlreadyRegistered))
+	t.True(errors.Is(m.Register("02", noop, nil), schemaver.ErrAlreadyRegistered))
+
+	t.DeepEqual(m.Versions(), []schemaver.Version{"1", "1.1", "2", "10"})
+	t.Equal(m.Latest(), schemaver.Version("10"))
+}
+
+func TestPath(tt *testing.T) {
+	t := check.T(tt)
+	noop := func(context.Context) error { return nil }
+
+	var m migrate.Migrations
+	t.Nil(m.Register("1", noop, noop))
+	t.Nil(m.Register("2", noop, nil))
+	t.Nil(m.RegisterTx("3", noop, noop))
+
+	path := func(from, to schemaver.Version) (steps []string, err error) {
+		ss, err := m.Path(from, to)
+		for _, s := range ss {
+			t.NotNil(s.Func)
+			steps = append(steps, s.String())
+		}
+		return steps, err
+	}
+
+	cases := []struct {
+		from, to schemaver.Version
+		want     []string
+		wantErr  error
+	}{
+		{"none", "none", nil, nil},
+		{"none", "3", []string{
+			"up none -> 1 (non-transactional)",
+			"up 1 -> 2 (non-transactional)",
+			"up 2 -> 3 (transactional)",
+		}, nil},
+		{"1", "3", []string{"up 1 -> 2 (non-transactional)", "up 2 -> 3 (transactional)"}, nil},
+		{"3", "3", nil, nil},
+		{"3", "2", []string{"down 3 -> 2 (transactional)"}, nil},
+		{"3", "1", nil, migrate.ErrIrreversible},
+		{"1", "none", []string{"down 1 -> none (non-transactional)"}, nil},
+		{"dirty", "3", nil, migrate.ErrDirty},
+		{"4", "3", nil, migrate.ErrUnknownVersion},
+		{"01", "3", []string{"up 1 -> 2 (non-transactional)", "up 2 -> 3 (transactional)"}, nil},
+		{"1", "3.0", nil, migrate.ErrUnknownVersion},
+		{"1", "03", []string{"up 1 -> 2 (non-transactional)", "up 2 -> 3 (transactional)"}, nil},
+		{"1", "4", nil, migrate.ErrUnknownVersion},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(string(tc.from)+"->"+string(tc.to), func(tt *testing.T) {
+			t := check.T(tt)
+			steps, err := path(tc.from, tc.to)
+			t.DeepEqual(steps, tc.want)
+			t.True(errors.Is(err, tc.wantErr), err)
+		})
+	}
+}
+
+func TestRun(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer os.RemoveAll(tempdir)
+	v, err := schemaver.NewAt("file://" + tempdir)
+	t.Nil(err)
+	defer v.Close()
+
+	var log []string
+	step := func(name string, err error) migrate.Func {
+		return func(context.Context) error {
+			log = append(log, name)
+			t.Equal(v.Get(), schemaver.BadVersion)
+			return err
+		}
+	}
+	var m migrate.Migrations
+	t.Nil(m.Register("1", step("up1", nil), step("down1", nil)))
+	t.Nil(m.Register("2", step("up2", nil), step("down2", nil)))
+	t.Nil(m.Register("3", step("up3", errMigrate), nil))
+
+	get := func() string {
+		v.SharedLock()
+		defer v.Unlock()
+		return v.Get()
+	}
+
+	// - up, success
+	t.Nil(m.Run(ctx, v, "2"))
+	t.DeepEqual(log, []string{"up1", "up2"})
+	t.Equal(get(), "2")
+
+	// - down, success
+	log = nil
+	t.Nil(m.Run(ctx, v, schemaver.NoVersion))
+	t.DeepEqual(log, []string{"down2", "down1"})
+	t.Equal(get(), schemaver.NoVersion)
+
+	// - up, fail on last step, dirty
+	log = nil
+	err = m.Run(ctx, v, "3")
+	t.DeepEqual(log, []string{"up1", "up2", "up3"})
+	t.True(errors.Is(err, errMigrate))
+	var migrateErr *schemaver.MigrateError
+	t.True(errors.As(err, &migrateErr))
+	t.Equal(migrateErr.From, schemaver.Version("2"))
+	t.Equal(migrateErr.To, schemaver.Version("3"))
+	t.Equal(get(), schemaver.BadVersion)
+
+	// - from dirty, error
+	log = nil
+	t.Err(m.Run(ctx, v, "2"), migrate.ErrDirty)
+	t.Nil(log)
+}
+
+func TestPlan(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir("", "gotest")
+	t.Nil(err)
+	defer os.RemoveAll(tempdir)
+	v, err := schemaver.NewAt("file://" + tempdir)
+	t.Nil(err)
+	defer v.Close()
+
+	calls := 0
+	step := func(context.Context) error { calls++; return nil }
+	var m migrate.Migrations
+	t.Nil(m.Register("1", step, step))
+	t.Nil(m.RegisterTx("2", step, step))
+
+	// - plan, nothing changed
+	plan, err := m.Plan(ctx, v, "2")
+	t.Nil(err)
+	t.Equal(plan.From, schemaver.Version(schemaver.NoVersion))
+	t.Equal(plan.To, schemaver.Version("2"))
+	t.Len(plan.Steps, 2)
+	t.Equal(plan.Steps[1].String(), "up 1 -> 2 (transactional)")
+	t.Zero(calls)
+	t.Equal(v.SharedLock(), schemaver.NoVersion)
+	v.Unlock()
+
+	// - plan after run, no steps
+	t.Nil(m.Run(ctx, v, "2"))
+	t.Equal(calls, 2)
+	plan, err = m.Plan(ctx, v, "2")
+	t.Nil(err)
+	t.Equal(plan.From, schemaver.Version("2"))
+	t.Len(plan.Steps, 0)
+
+	// - unknown version, error
+	_, err = m.Plan(ctx, v, "3")
+	t.Err(err, migrate.ErrUnknownVersion)
+
+	// - under exclusive lock of another goroutine, wait for it
+	lock, err := v.Exclusive(ctx)
+	t.Nil(err)
+	ctxTimeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = m.Plan(ctxTimeout, v, "2")
+	t.Err(err, context.DeadlineExceeded)
+	t.Nil(lock.Release())
+}
@@ -0,0 +1,228 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+const (
+	sqlUpSuffix   = ".up.sql"
+	sqlDownSuffix = ".down.sql"
+)
+
+// implicitCommit matches statements (without leading comments) which
+// cause an implicit commit in MySQL.
+var implicitCommit = regexp.MustCompile(`(?i)^(?:` + //nolint:gochecknoglobals // Const.
+	`ALTER|CREATE|DROP|RENAME|TRUNCATE|` +
+	`BEGIN|START|COMMIT|SET\s+AUTOCOMMIT|LOCK|UNLOCK|` +
+	`GRANT|REVOKE|SET\s+PASSWORD|` +
+	`ANALYZE|OPTIMIZE|REPAIR|CACHE|LOAD\s+INDEX|FLUSH|RESET|INSTALL|UNINSTALL` +
+	`)\b`)
+
+// SQLOptions contains settings for RegisterSQL.
+type SQLOptions struct {
+	// SingleStatement requires each file to contain exactly one
+	// statement. It's recommended for MySQL, where statements like
+	// CREATE/ALTER/DROP TABLE cause an implicit commit, so failed
+	// migration with several statements can't be rolled back.
+	SingleStatement bool
+}
+
+type sqlFile struct {
+	name  string
+	stmts []string
+}
+
+// RegisterSQL registers migrations loaded from files in root directory
+// of fsys (use os.DirFS for a directory or embed.FS) named
+// NNN_name.up.sql and NNN_name.down.sql (down is optional). NNN is a
+// version (e.g. "001" or "1.2") with leading zeroes removed from each
+// number (so "001" is version "1"). Other files are ignored.
+//
+// Migration runs statements separated by ";" one by one in a
+// transaction using db. DELIMITER is not supported. Migration is
+// transactional (see RegisterTx) unless it contains statements which
+// cause an implicit commit in MySQL (like CREATE TABLE).
+func (m *Migrations) RegisterSQL(fsys fs.FS, db *sql.DB, opts SQLOptions) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	ups := make(map[schemaver.Version]*sqlFile)
+	downs := make(map[schemaver.Version]*sqlFile)
+	for _, entry := range entries {
+		name := entry.Name()
+		files := ups
+		switch {
+		case entry.IsDir():
+			continue
+		case strings.HasSuffix(name, sqlDownSuffix):
+			files = downs
+		case !strings.HasSuffix(name, sqlUpSuffix):
+			continue
+		}
+
+		ver, err := parseSQLFileName(name)
+		if err != nil {
+			return err
+		}
+		if files[ver] != nil {
+			return fmt.Errorf("%w: %q and %q", ErrDuplicateMigration, files[ver].name, name)
+		}
+		buf, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		f := &sqlFile{name: name, stmts: splitSQL(string(buf))}
+		if opts.SingleStatement && len(f.stmts) != 1 {
+			return fmt.Errorf("%w: %q contains %d", ErrSingleStatement, name, len(f.stmts))
+		}
+		files[ver] = f
+	}
+
+	for ver := range downs {
+		if ups[ver] == nil {
+			return fmt.Errorf("%w for %q", ErrNoUpMigration, downs[ver].name)
+		}
+	}
+	vers := make([]schemaver.Version, 0, len(ups))
+	for ver := range ups {
+		vers = append(vers, ver)
+	}
+	sort.Slice(vers, func(i, j int) bool { return vers[i].Compare(vers[j]) < 0 })
+	for _, ver := range vers {
+		mig := migration{ver: ver, up: ups[ver].migrate(db), upTx: ups[ver].transactional()}
+		if downs[ver] != nil {
+			mig.down, mig.downTx = downs[ver].migrate(db), downs[ver].transactional()
+		}
+		err = m.register(mig)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSQLFileName returns version from NNN_name.up.sql or
+// NNN_name.down.sql.
+func parseSQLFileName(name string) (schemaver.Version, error) {
+	i := strings.IndexByte(name, '_')
+	if i <= 0 {
+		return "", fmt.Errorf("%w: %q", ErrSQLFileName, name)
+	}
+	parts := strings.Split(name[:i], ".")
+	for j := range parts {
+		if parts[j] == "" || strings.Trim(parts[j], "0123456789") != "" {
+			return "", fmt.Errorf("%w: %q", ErrSQLFileName, name)
+		}
+		parts[j] = strings.TrimLeft(parts[j], "0")
+		if parts[j] == "" {
+			parts[j] = "0"
+		}
+	}
+	return schemaver.Version(strings.Join(parts, ".")), nil
+}
+
+// transactional returns false if some statement may cause an implicit
+// commit. It uses MySQL rules, which is a safe choice for other
+// databases.
+func (f *sqlFile) transactional() bool {
+	for _, stmt := range f.stmts {
+		if implicitCommit.MatchString(skipComments(stmt)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *sqlFile) migrate(db *sql.DB) Func {
+	return func(ctx context.Context) error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // Defer.
+		for _, stmt := range f.stmts {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("%s: %w", f.name, err)
+			}
+		}
+		return tx.Commit()
+	}
+}
+
+// splitSQL returns statements separated by ";" (which is ignored inside
+// quotes and comments). Statements which contains only spaces and
+// comments are skipped.
+func splitSQL(s string) []string {
+	var stmts []string
+	start, hasCode := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			hasCode = true
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+		case c == '#', strings.HasPrefix(s[i:], "--") && (i+2 == len(s) || isSpace(s[i+2])):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end == -1 {
+				i = len(s)
+			} else {
+				i += 2 + end + 1
+			}
+		case c == ';':
+			if hasCode {
+				stmts = append(stmts, strings.TrimSpace(s[start:i]))
+			}
+			start, hasCode = i+1, false
+		case !isSpace(c):
+			hasCode = true
+		}
+	}
+	if hasCode {
+		stmts = append(stmts, strings.TrimSpace(s[start:]))
+	}
+	return stmts
+}
+
+// skipComments returns stmt without leading spaces and comments.
+func skipComments(stmt string) string {
+	for {
+		stmt = strings.TrimLeft(stmt, " \t\r\n")
+		switch {
+		case strings.HasPrefix(stmt, "#"), strings.HasPrefix(stmt, "--"):
+			i := strings.IndexByte(stmt, '\n')
+			if i == -1 {
+				return ""
+			}
+			stmt = stmt[i+1:]
+		case strings.HasPrefix(stmt, "/*"):
+			i := strings.Index(stmt, "*/")
+			if i == -1 {
+				return ""
+			}
+			stmt = stmt[i+2:]
+		default:
+			return stmt
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,143 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+	"github.com/powerman/narada4d/schemaver/migrate"
+)
+
+func init() {
+	sql.Register("migrate-test", &mockDriver{})
+}
+
+var (
+	errExec = errors.New("exec failed")
+	execMu  sync.Mutex
+	execLog []string
+)
+
+func TestRegisterSQL(tt *testing.T) {
+	t := check.T(tt)
+	ctx := context.Background()
+	db, err := sql.Open("migrate-test", "")
+	t.Nil(err)
+	defer db.Close()
+	exec := func(f migrate.Func) ([]string, error) {
+		execMu.Lock()
+		execLog = nil
+		execMu.Unlock()
+		err := f(ctx)
+		execMu.Lock()
+		defer execMu.Unlock()
+		return execLog, err
+	}
+
+	fsys := fstest.MapFS{
+		"README.md":        {Data: []byte("not a migration")},
+		"sub/3_x.up.sql":   {Data: []byte("SELECT 3")},
+		"001_init.up.sql":  {Data: []byte("CREATE TABLE a (s TEXT);\n-- ; comment\nINSERT INTO a VALUES ('x;\\'y')")},
+		"1_init.down.sql":  {Data: []byte("/* ; */ DROP TABLE a; # ;\n")},
+		"1.10_fail.up.sql": {Data: []byte("SELECT 1; FAIL; SELECT 2")},
+		"1.2_empty.up.sql": {Data: []byte(" -- nothing;\n")},
+	}
+
+	var m migrate.Migrations
+	t.Nil(m.RegisterSQL(fsys, db, migrate.SQLOptions{}))
+	t.DeepEqual(m.Versions(), []schemaver.Version{"1", "1.2", "1.10"})
+
+	steps, err := m.Path(schemaver.NoVersion, "1.10")
+	t.Nil(err)
+	t.Len(steps, 3)
+	t.False(steps[0].Transactional) // CREATE TABLE.
+	t.True(steps[1].Transactional)
+	t.True(steps[2].Transactional)
+	stmts, err := exec(steps[0].Func)
+	t.Nil(err)
+	t.DeepEqual(stmts, []string{"BEGIN", "CREATE TABLE a (s TEXT)", "-- ; comment\nINSERT INTO a VALUES ('x;\\'y')", "COMMIT"})
+	stmts, err = exec(steps[1].Func)
+	t.Nil(err)
+	t.DeepEqual(stmts, []string{"BEGIN", "COMMIT"})
+	stmts, err = exec(steps[2].Func)
+	t.Err(err, errExec)
+	t.Match(err, `^1.10_fail.up.sql: exec failed$`)
+	t.DeepEqual(stmts, []string{"BEGIN", "SELECT 1", "FAIL", "ROLLBACK"})
+
+	_, err = m.Path("1.2", "1")
+	t.Err(err, migrate.ErrIrreversible)
+	steps, err = m.Path("1", schemaver.NoVersion)
+	t.Nil(err)
+	t.Len(steps, 1)
+	t.False(steps[0].Transactional) // DROP TABLE after comment.
+	stmts, err = exec(steps[0].Func)
+	t.Nil(err)
+	t.DeepEqual(stmts, []string{"BEGIN", "/* ; */ DROP TABLE a", "COMMIT"})
+
+	// - already registered, error
+	t.True(errors.Is(m.RegisterSQL(fsys, db, migrate.SQLOptions{}), schemaver.ErrAlreadyRegistered))
+
+	cases := []struct {
+		name    string
+		files   fstest.MapFS
+		opts    migrate.SQLOptions
+		wantErr error
+	}{
+		{"bad name", fstest.MapFS{"init.up.sql": {}}, migrate.SQLOptions{}, migrate.ErrSQLFileName},
+		{"bad version", fstest.MapFS{"v1_init.up.sql": {}}, migrate.SQLOptions{}, migrate.ErrSQLFileName},
+		{"no up", fstest.MapFS{"1_a.up.sql": {}, "2_b.down.sql": {}}, migrate.SQLOptions{}, migrate.ErrNoUpMigration},
+		{"duplicate", fstest.MapFS{"1_a.up.sql": {}, "01_b.up.sql": {}}, migrate.SQLOptions{}, migrate.ErrDuplicateMigration},
+		{"single", fstest.MapFS{"1_a.up.sql": {Data: []byte("SELECT 1;")}}, migrate.SQLOptions{SingleStatement: true}, nil},
+		{"single, empty", fstest.MapFS{"1_a.up.sql": {Data: []byte("-- ;")}}, migrate.SQLOptions{SingleStatement: true}, migrate.ErrSingleStatement},
+		{"single, two", fstest.MapFS{"1_a.up.sql": {Data: []byte("SELECT 1; SELECT 2")}}, migrate.SQLOptions{SingleStatement: true}, migrate.ErrSingleStatement},
+		{"single, down", fstest.MapFS{"1_a.up.sql": {Data: []byte("SELECT 1")}, "1_a.down.sql": {}}, migrate.SQLOptions{SingleStatement: true}, migrate.ErrSingleStatement},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(tt *testing.T) {
+			t := check.T(tt)
+			var m migrate.Migrations
+			err := m.RegisterSQL(tc.files, db, tc.opts)
+			t.True(errors.Is(err, tc.wantErr), err)
+			if tc.wantErr != nil {
+				t.Len(m.Versions(), 0)
+			}
+		})
+	}
+}
+
+type mockDriver struct{}
+
+func (mockDriver) Open(string) (driver.Conn, error) { return mockConn{}, nil }
+
+type mockConn struct{}
+
+func (mockConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (mockConn) Close() error                        { return nil }
+func (mockConn) Begin() (driver.Tx, error)           { logExec("BEGIN"); return mockTx{}, nil }
+
+func (mockConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	logExec(query)
+	if query == "FAIL" {
+		return nil, errExec
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type mockTx struct{}
+
+func (mockTx) Commit() error   { logExec("COMMIT"); return nil }
+func (mockTx) Rollback() error { logExec("ROLLBACK"); return nil }
+
+func logExec(query string) {
+	execMu.Lock()
+	defer execMu.Unlock()
+	execLog = append(execLog, query)
+}
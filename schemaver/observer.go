@@ -0,0 +1,59 @@
+package schemaver
+
+import (
+	"context"
+	"time"
+)
+
+// Observer may be set using SetObserver to get notified about locks and
+// other operations with protocol, e.g. to collect metrics or traces.
+//
+// Methods are called synchronously, so they should be fast. They must
+// be safe for concurrent use if same Observer is used by several
+// SchemaVer.
+//
+// Recursive locks (including locks acquired by parent process, see
+// EnvSkipLock) do not use protocol and thus won't be observed.
+//
+// For LockReleased, Get and Set ctx is a ctx used to acquire lock.
+type Observer interface {
+	// LockRequested is called before waiting for a lock.
+	LockRequested(ctx context.Context, typ LockType)
+	// LockAcquired is called after waiting for a lock, err is not nil
+	// if lock wasn't acquired.
+	LockAcquired(ctx context.Context, typ LockType, wait time.Duration, err error)
+	// LockReleased is called after releasing a lock.
+	LockReleased(ctx context.Context, typ LockType, held time.Duration, err error)
+	// Get is called after getting version.
+	Get(ctx context.Context, ver Version, d time.Duration, err error)
+	// Set is called after setting version.
+	Set(ctx context.Context, ver Version, d time.Duration, err error)
+	// BackendError is called on errors returned by protocol (excluding
+	// ErrWouldBlock, ErrNotSupported and ctx.Err). Op is a name of
+	// Manage method (like "ExclusiveLock" or "Get").
+	BackendError(ctx context.Context, op string, err error)
+}
+
+// NopObserver is an Observer which does nothing. It's used by default
+// and may be embedded to implement only some of Observer methods.
+type NopObserver struct{}
+
+var _ Observer = NopObserver{}
+
+// LockRequested implements Observer.
+func (NopObserver) LockRequested(context.Context, LockType) {}
+
+// LockAcquired implements Observer.
+func (NopObserver) LockAcquired(context.Context, LockType, time.Duration, error) {}
+
+// LockReleased implements Observer.
+func (NopObserver) LockReleased(context.Context, LockType, time.Duration, error) {}
+
+// Get implements Observer.
+func (NopObserver) Get(context.Context, Version, time.Duration, error) {}
+
+// Set implements Observer.
+func (NopObserver) Set(context.Context, Version, time.Duration, error) {}
+
+// BackendError implements Observer.
+func (NopObserver) BackendError(context.Context, string, error) {}
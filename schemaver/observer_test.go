@@ -0,0 +1,178 @@
+package schemaver_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+type recordObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordObserver) add(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordObserver) get() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func (o *recordObserver) LockRequested(_ context.Context, typ schemaver.LockType) {
+	o.add("requested %s", typ)
+}
+
+func (o *recordObserver) LockAcquired(_ context.Context, typ schemaver.LockType, _ time.Duration, err error) {
+	o.add("acquired %s %v", typ, err)
+}
+
+func (o *recordObserver) LockReleased(_ context.Context, typ schemaver.LockType, _ time.Duration, err error) {
+	o.add("released %s %v", typ, err)
+}
+
+func (o *recordObserver) Get(_ context.Context, ver schemaver.Version, _ time.Duration, err error) {
+	o.add("get %s %v", ver, err)
+}
+
+func (o *recordObserver) Set(_ context.Context, ver schemaver.Version, _ time.Duration, err error) {
+	o.add("set %s %v", ver, err)
+}
+
+func (o *recordObserver) BackendError(_ context.Context, op string, err error) {
+	o.add("error %s %v", op, err)
+}
+
+// heldObserver tracks backend lock and let tests wait for its changes.
+type heldObserver struct {
+	schemaver.NopObserver
+	mu       sync.Mutex
+	held     bool
+	acquired int
+	changed  chan struct{}
+}
+
+func newHeldObserver() *heldObserver {
+	return &heldObserver{changed: make(chan struct{})}
+}
+
+func (o *heldObserver) LockAcquired(_ context.Context, _ schemaver.LockType, _ time.Duration, err error) {
+	if err == nil {
+		o.update(func() { o.held = true; o.acquired++ })
+	}
+}
+
+func (o *heldObserver) LockReleased(context.Context, schemaver.LockType, time.Duration, error) {
+	o.update(func() { o.held = false })
+}
+
+func (o *heldObserver) update(f func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f()
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+func (o *heldObserver) state() (held bool, acquired int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.held, o.acquired
+}
+
+// wait returns false if cond won't become true in a second.
+func (o *heldObserver) wait(cond func(held bool, acquired int) bool) bool {
+	timeout := time.After(testSecond)
+	for {
+		o.mu.Lock()
+		ok, changed := cond(o.held, o.acquired), o.changed
+		o.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func (o *heldObserver) waitHeld() bool {
+	return o.wait(func(held bool, _ int) bool { return held })
+}
+
+func (o *heldObserver) waitAcquired(n int) bool {
+	return o.wait(func(_ bool, acquired int) bool { return acquired >= n })
+}
+
+func TestObserver(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	o := &recordObserver{}
+	v.SetObserver(o)
+
+	// - SH, SH (recursive), Get, UN, UN
+	v.SharedLock()
+	v.SharedLock()
+	v.Get()
+	v.Unlock()
+	v.Unlock()
+	t.DeepEqual(o.get(), []string{
+		"requested shared",
+		"acquired shared <nil>",
+		"get 42 <nil>",
+		"get 42 <nil>",
+		"released shared <nil>",
+	})
+
+	// - EX, Set (backend panic), Set, UN
+	v.ExclusiveLock()
+	t.PanicMatch(func() { v.Set("666") }, `mock panic`)
+	v.Set("43")
+	v.Unlock()
+	t.DeepEqual(o.get(), []string{
+		"requested exclusive",
+		"acquired exclusive <nil>",
+		"get 42 <nil>",
+		"set 666 backend panic: mock panic",
+		"error Set backend panic: mock panic",
+		"set 43 <nil>",
+		"released exclusive <nil>",
+	})
+
+	// - TrySH (would block), SH (canceled), no backend errors
+	block = make(chan struct{})
+	_, err = v.TrySharedLock()
+	t.Err(err, schemaver.ErrWouldBlock)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = v.SharedLockContext(ctx)
+	t.Err(err, context.Canceled)
+	t.DeepEqual(o.get(), []string{
+		"requested shared",
+		"acquired shared lock would block",
+	})
+
+	// - SetObserver(nil)
+	close(block)
+	v.SetObserver(nil)
+	v.SharedLock()
+	v.Unlock()
+	t.Len(o.get(), 0)
+}
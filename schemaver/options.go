@@ -0,0 +1,122 @@
+package schemaver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/powerman/narada4d/internal"
+)
+
+// Logger is an interface implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Option is an option for New and NewAt.
+type Option func(*Options)
+
+// Options contains settings set by Option. They are also passed to
+// protocol (see Backend.NewWithOptions), which may use own defaults for
+// zero values and override settings using location query params.
+type Options struct {
+	// LockTimeout limits time spent waiting for a lock (including
+	// waiting for supported version because of PolicyWait) by
+	// SharedLock, ExclusiveLock, Shared, Exclusive and Upgrade. Zero
+	// means no limit.
+	LockTimeout time.Duration
+	// DialTimeout limits time spent on connecting to database.
+	DialTimeout time.Duration
+	// ReadWriteTimeout limits time spent on each network read and
+	// write. Protocols which wait for lock by waiting for response to
+	// a query (e.g. mysql) will also drop connection if lock wasn't
+	// acquired in time and retry with a new one, so it should be
+	// greater than expected lock wait time. Zero means no limit (use
+	// LockTimeout and PingInterval to detect network issues).
+	ReadWriteTimeout time.Duration
+	// PingInterval is how often lock is checked by LockLost. It must
+	// be positive (zero means default).
+	PingInterval time.Duration
+	// BackOff returns new backoff used by protocol to retry failed
+	// operations (e.g. on network errors).
+	BackOff func() backoff.BackOff
+	// Logger is used to log retries, migrations and other errors
+	// which won't be returned to caller. Nothing is logged if it's nil.
+	Logger Logger
+}
+
+// WithLockTimeout sets Options.LockTimeout.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(o *Options) { o.LockTimeout = timeout }
+}
+
+// WithDialTimeout sets Options.DialTimeout.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *Options) { o.DialTimeout = timeout }
+}
+
+// WithReadWriteTimeout sets Options.ReadWriteTimeout.
+func WithReadWriteTimeout(timeout time.Duration) Option {
+	return func(o *Options) { o.ReadWriteTimeout = timeout }
+}
+
+// WithPingInterval sets Options.PingInterval.
+func WithPingInterval(interval time.Duration) Option {
+	return func(o *Options) { o.PingInterval = interval }
+}
+
+// WithBackOff sets Options.BackOff.
+func WithBackOff(newBackOff func() backoff.BackOff) Option {
+	return func(o *Options) { o.BackOff = newBackOff }
+}
+
+// WithLogger sets Options.Logger.
+func WithLogger(logger Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func newOptions(opts []Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.PingInterval == 0 {
+		o.PingInterval = pingInterval
+	}
+	return o
+}
+
+// validate returns error matching ErrInvalidOption if options can't
+// be used.
+func (o Options) validate() error {
+	if o.PingInterval <= 0 {
+		return fmt.Errorf("%w: PingInterval must be positive: %v", ErrInvalidOption, o.PingInterval)
+	}
+	return nil
+}
+
+// NewBackOff returns result of BackOff or default backoff (exponential,
+// up to 3 minutes) if BackOff is nil.
+func (o Options) NewBackOff() backoff.BackOff {
+	if o.BackOff == nil {
+		return internal.NewBackOff()
+	}
+	return o.BackOff()
+}
+
+// Logf logs using Logger if it's not nil.
+func (o Options) Logf(format string, v ...interface{}) {
+	if o.Logger != nil {
+		o.Logger.Printf(format, v...)
+	}
+}
+
+// withLockTimeout returns ctx limited by LockTimeout.
+func (o Options) withLockTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.LockTimeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.LockTimeout)
+}
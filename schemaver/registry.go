@@ -0,0 +1,162 @@
+package schemaver
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// DefaultRegistry is used by RegisterProtocol, Initialize, New, NewAt
+// and NewWithManage.
+//
+// It contains aliases "mariadb" for "mysql" and "postgresql" for
+// "goose-postgres".
+var DefaultRegistry = &Registry{ //nolint:gochecknoglobals // By design.
+	aliases: map[string]string{
+		"mariadb":    "mysql",
+		"postgresql": "goose-postgres",
+	},
+}
+
+// Registry contains registered protocols and their aliases.
+//
+// The zero value is an empty registry ready to use. It's safe for
+// concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	backends map[string]*Backend
+	aliases  map[string]string
+}
+
+// Register adds protocol implemented by backend. It returns error if
+// protocol or alias with same name is already registered or backend has
+// nil implementation.
+func (r *Registry) Register(proto string, backend Backend) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.backends[proto] != nil || r.aliases[proto] != "" {
+		return fmt.Errorf("protocol %q %w", proto, ErrAlreadyRegistered)
+	} else if backend.Initialize == nil || backend.New == nil && backend.NewWithOptions == nil {
+		return fmt.Errorf("can't register protocol %q with nil implementation", proto) //nolint:goerr113 // Programming error.
+	}
+
+	if r.backends == nil {
+		r.backends = make(map[string]*Backend)
+	}
+	r.backends[proto] = &backend
+	return nil
+}
+
+// Alias adds another name for protocol. Protocol may be registered
+// after alias. It returns error if protocol or alias with same name is
+// already registered.
+func (r *Registry) Alias(alias, proto string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.backends[alias] != nil || r.aliases[alias] != "" {
+		return fmt.Errorf("protocol %q %w", alias, ErrAlreadyRegistered)
+	}
+
+	if r.aliases == nil {
+		r.aliases = make(map[string]string)
+	}
+	r.aliases[alias] = proto
+	return nil
+}
+
+// Lookup returns backend of protocol or alias or error matching
+// ErrUnknownProtocol.
+func (r *Registry) Lookup(proto string) (Backend, error) {
+	_, backend, err := r.lookup(proto)
+	if err != nil {
+		return Backend{}, err
+	}
+	return *backend, nil
+}
+
+// lookup returns protocol name (resolving alias) and it's backend.
+func (r *Registry) lookup(proto string) (string, *Backend, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name := proto
+	if alias := r.aliases[proto]; alias != "" {
+		name = alias
+	}
+	backend := r.backends[name]
+	if backend == nil {
+		return "", nil, fmt.Errorf("%w: %q", ErrUnknownProtocol, proto)
+	}
+	return name, backend, nil
+}
+
+// Protocols returns sorted names of registered protocols (without
+// aliases).
+func (r *Registry) Protocols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	protos := make([]string, 0, len(r.backends))
+	for proto := range r.backends {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	return protos
+}
+
+// NewAt works like package-level NewAt but uses protocols registered
+// in r.
+func (r *Registry) NewAt(location string, opts ...Option) (*SchemaVer, error) {
+	loc, backend, err := r.parseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	pristine := *loc // Backend.New may modify loc.
+	return r.newSchemaVer(newLocation(loc, backend), func(o Options) (Manage, error) {
+		loc := pristine
+		return backend.new(&loc, o)
+	}, newOptions(opts))
+}
+
+// NewWithManage works like package-level NewWithManage but uses
+// protocols registered in r.
+func (r *Registry) NewWithManage(location string, newManage func(Options) (Manage, error), opts ...Option) (*SchemaVer, error) {
+	loc, backend, err := r.parseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return r.newSchemaVer(newLocation(loc, backend), newManage, newOptions(opts))
+}
+
+// Initialize works like package-level Initialize but uses given
+// location and protocols registered in r.
+func (r *Registry) Initialize(location string) error {
+	loc, backend, err := r.parseLocation(location)
+	if err != nil {
+		return err
+	}
+	return backend.Initialize(loc)
+}
+
+// parseLocation returns location with alias replaced by protocol name
+// and protocol's backend.
+func (r *Registry) parseLocation(location string) (*url.URL, *Backend, error) {
+	loc, err := url.Parse(location)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err // Do not leak location with password.
+		}
+		return nil, nil, fmt.Errorf("narada4d: invalid location: %w", err)
+	}
+	proto, backend, err := r.lookup(loc.Scheme)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc.Scheme = proto
+	return loc, backend, nil
+}
@@ -5,11 +5,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/url"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/powerman/narada4d/internal"
 )
 
 const (
@@ -23,239 +26,958 @@ const (
 	// schema version. For example: file:///some/path/.
 	EnvLocation = "NARADA4D"
 	// EnvSkipLock must be set to non-empty value in case
-	// ExclusiveLock was already acquired (by parent process).
+	// ExclusiveLock was already acquired (by parent process). It
+	// contains space-separated IDs of locked locations (see
+	// Location.ID), each followed by "=token" if protocol supports
+	// tokens (see ManageToken).
 	EnvSkipLock = "NARADA4D_SKIP_LOCK"
 )
 
-var errUnknownProtocol = errors.New("narada4d: unknown protocol")
-
-func parseLocation(location string) (*url.URL, error) {
-	loc, err := url.Parse(location)
-	if err != nil {
-		return nil, fmt.Errorf("narada4d: %w", err)
-	}
-	if registered[loc.Scheme] == nil {
-		return nil, fmt.Errorf("%w: %q", errUnknownProtocol, loc.Scheme)
-	}
-	return loc, nil
-}
-
 // Initialize initialize version at location provided in $NARADA4D.
 //
 // Version must not be already initialized.
 func Initialize() error {
-	loc, err := parseLocation(os.Getenv(EnvLocation))
-	if err != nil {
-		return err
-	}
-	return registered[loc.Scheme].Initialize(loc)
+	return DefaultRegistry.Initialize(os.Getenv(EnvLocation))
 }
 
-type lockType int
+// LockType is a type of lock.
+type LockType int
 
+// Lock types.
 const (
-	unlocked lockType = iota
-	shared
-	exclusive
+	unlocked LockType = iota
+	LockShared
+	LockExclusive
 )
 
+func (t LockType) String() string {
+	switch t {
+	case LockShared:
+		return "shared"
+	case LockExclusive:
+		return "exclusive"
+	default:
+		return "unlocked"
+	}
+}
+
+const pingInterval = time.Second
+
 // SchemaVer manage data schema versions.
 type SchemaVer struct {
-	loc        *url.URL
-	backend    Manage
-	mu         sync.Mutex
-	lockType   lockType
-	skipUnlock int
+	registry   *Registry
+	loc        Location
+	newManage  func() (Manage, error)
+	manage     Manage
+	backend    ManageV2
+	mu         ctxMutex
+	lockType   LockType // Lock acquired using protocol.
+	acquiring  bool     // Lock is being acquired using protocol without v.mu.
+	inherited  bool     // Lock acquired by parent process, see EnvSkipLock.
+	lockCtx    context.Context
+	lockedAt   time.Time
+	observer   Observer
 	sharedVer  string
+	legacy     int            // Amount of SharedLock and ExclusiveLock.
+	legacyBy   map[uint64]int // Amount of SharedLock and ExclusiveLock by goroutine ID.
+	handles    int            // Amount of Shared and Exclusive.
+	handlesBy  map[uint64]int // Amount of Shared and Exclusive by goroutine ID which acquired them.
+	released   chan struct{}
 	callbacks  []func(string)
+	constraint Constraint
+	policy     Policy
 	holdWG     sync.WaitGroup
 	holdQuit   chan struct{}
+	lost       chan error
+	opts       Options
+	pingStop   chan struct{} // Closed to stop ping goroutine.
+
+	exclusiveWaiting int
 }
 
 // New creates object for managing data schema version at location
 // provided in $NARADA4D.
 //
 // Will initialize version if it's not initialized yet.
-func New() (*SchemaVer, error) {
-	return NewAt(os.Getenv(EnvLocation))
+func New(opts ...Option) (*SchemaVer, error) {
+	return NewAt(os.Getenv(EnvLocation), opts...)
 }
 
 // NewAt creates object for managing data schema version at location.
 //
 // Will initialize version if it's not initialized yet.
-func NewAt(location string) (*SchemaVer, error) {
-	loc, err := parseLocation(location)
-	if err != nil {
+func NewAt(location string, opts ...Option) (*SchemaVer, error) {
+	return DefaultRegistry.NewAt(location, opts...)
+}
+
+// NewWithManage creates object for managing data schema version using
+// protocol implementation returned by newManage. It's intended for
+// protocols which provide own constructors (e.g. using existing
+// database connection pool).
+//
+// Location is used only to identify data schema version (see
+// EnvSkipLock), its protocol must be registered. Function newManage is
+// called once to create Manage used for locking and may be called again
+// by Watch, it must return Manage with initialized version.
+func NewWithManage(location string, newManage func(Options) (Manage, error), opts ...Option) (*SchemaVer, error) {
+	return DefaultRegistry.NewWithManage(location, newManage, opts...)
+}
+
+func (r *Registry) newSchemaVer(loc Location, newManage func(Options) (Manage, error), o Options) (*SchemaVer, error) {
+	if err := o.validate(); err != nil {
 		return nil, err
 	}
-	backend, err := registered[loc.Scheme].New(loc)
+	backend, err := newManage(o)
 	if err != nil {
 		return nil, err
 	}
 
 	v := &SchemaVer{
-		loc:      loc,
-		backend:  backend,
-		holdQuit: make(chan struct{}),
+		registry:  r,
+		loc:       loc,
+		newManage: func() (Manage, error) { return newManage(o) },
+		manage:    backend,
+		backend:   newManageV2(backend),
+		mu:        make(ctxMutex, 1),
+		lockCtx:   context.Background(),
+		observer:  NopObserver{},
+		released:  make(chan struct{}),
+		holdQuit:  make(chan struct{}),
+		lost:      make(chan error, 1),
+		opts:      o,
 	}
 	if v.isSkipLock() {
-		v.lockType = exclusive
+		v.lockType = LockExclusive
+		v.inherited = true
 	}
 
 	return v, nil
 }
 
+// Location returns location of data schema version.
+func (v *SchemaVer) Location() Location {
+	return v.loc
+}
+
+// Inherited returns true if exclusive lock is held by parent process
+// (see EnvSkipLock), so locks won't be acquired using protocol.
+func (v *SchemaVer) Inherited() bool {
+	return v.inherited
+}
+
 //nolint:gochecknoglobals // By design.
 var muEnv sync.Mutex
 
+// ctxMutex is a mutex which LockContext can be interrupted by ctx.Done.
+type ctxMutex chan struct{}
+
+func (m ctxMutex) Lock() { m <- struct{}{} }
+
+func (m ctxMutex) LockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m ctxMutex) Unlock() { <-m }
+
 func (v *SchemaVer) isSkipLock() bool {
 	muEnv.Lock()
 	defer muEnv.Unlock()
 
-	envs := strings.Fields(os.Getenv(EnvSkipLock))
-	if len(envs) == 0 {
-		return false
-	}
-	if _, err := parseLocation(envs[0]); err != nil {
-		return true // For compatibility with NARADA4D_SKIP_LOCK=1 used before.
-	}
-	for i := range envs {
-		if loc, err := parseLocation(envs[i]); err == nil && loc.String() == v.loc.String() {
+	for _, env := range strings.Fields(os.Getenv(EnvSkipLock)) {
+		token, ok := v.matchSkipLock(env)
+		if !ok {
+			continue
+		}
+		err := v.verifySkipLock(token)
+		if err == nil {
 			return true
 		}
+		v.opts.Logf("narada4d: ignore %s entry for %s: %v", EnvSkipLock, v.loc, err)
 	}
 	return false
 }
 
-func (v *SchemaVer) setSkipLock() {
-	muEnv.Lock()
-	defer muEnv.Unlock()
+// matchSkipLock returns true and token (if any) if EnvSkipLock entry
+// set by setSkipLock (or by older versions, which used location instead
+// of it's ID) matches v.
+func (v *SchemaVer) matchSkipLock(env string) (token string, ok bool) {
+	if i := strings.LastIndexByte(env, '='); i > 0 && isLocationID(env[:i]) {
+		env, token = env[:i], env[i+1:]
+	}
+	if env == v.loc.ID() {
+		return token, true
+	}
+	loc, backend, err := v.registry.parseLocation(env)
+	return token, err == nil && newLocation(loc, backend).ID() == v.loc.ID()
+}
 
-	envs := strings.Fields(os.Getenv(EnvSkipLock))
-	for i := range envs {
-		if loc, err := parseLocation(envs[i]); err == nil && loc.String() == v.loc.String() {
-			return
-		}
+// verifySkipLock returns nil if protocol doesn't support tokens or
+// token proves lock is held by parent process.
+func (v *SchemaVer) verifySkipLock(token string) (err error) {
+	defer recoverErr(&err)
+	m, ok := v.manage.(ManageToken)
+	switch {
+	case !ok:
+		return nil
+	case token == "":
+		return fmt.Errorf("%w: absent", ErrInvalidToken)
 	}
+	return m.VerifyToken(token)
+}
 
-	envs = append(envs, v.loc.String())
-	err := os.Setenv(EnvSkipLock, strings.Join(envs, " "))
+func (v *SchemaVer) setSkipLock() error {
+	token, err := func() (_ string, err error) {
+		defer recoverErr(&err)
+		if m, ok := v.manage.(ManageToken); ok {
+			return m.Token()
+		}
+		return "", nil
+	}()
 	if err != nil {
-		panic(err)
+		v.backendError(v.lockCtx, "Token", err)
+		return err
+	}
+	entry := v.loc.ID()
+	if token != "" {
+		entry += "=" + token
 	}
+
+	muEnv.Lock()
+	defer muEnv.Unlock()
+
+	envs := v.withoutSkipLock(strings.Fields(os.Getenv(EnvSkipLock)))
+	envs = append(envs, entry)
+	return os.Setenv(EnvSkipLock, strings.Join(envs, " "))
 }
 
-func (v *SchemaVer) unsetSkipLock() {
+func (v *SchemaVer) unsetSkipLock() error {
 	muEnv.Lock()
 	defer muEnv.Unlock()
 
-	envs := strings.Fields(os.Getenv(EnvSkipLock))
+	envs := v.withoutSkipLock(strings.Fields(os.Getenv(EnvSkipLock)))
+	if len(envs) > 0 {
+		return os.Setenv(EnvSkipLock, strings.Join(envs, " "))
+	}
+	return os.Unsetenv(EnvSkipLock)
+}
+
+// withoutSkipLock returns envs without entries matching v.
+func (v *SchemaVer) withoutSkipLock(envs []string) []string {
 	for i := len(envs) - 1; i >= 0; i-- {
-		if loc, err := parseLocation(envs[i]); err == nil && loc.String() == v.loc.String() {
+		if _, ok := v.matchSkipLock(envs[i]); ok {
 			copy(envs[i:], envs[i+1:])
 			envs = envs[:len(envs)-1]
 		}
 	}
-
-	var err error
-	if len(envs) > 0 {
-		err = os.Setenv(EnvSkipLock, strings.Join(envs, " "))
-	} else {
-		err = os.Unsetenv(EnvSkipLock)
-	}
-	if err != nil {
-		panic(err)
-	}
+	return envs
 }
 
-// HoldSharedLock will start goroutine which will acquire SharedLock and
-// keep it until Close or ctx.Done. It'll release and immediately
-// re-acquire SharedLock every relockEvery to give someone else a chance
-// to get ExclusiveLock.
+// Watch will start goroutine which will send current version to
+// returned channel and then send new version after each change until
+// Close or ctx.Done. Channel will be closed after that.
 //
-// This is recommended optimization in case you've to do a lot of
-// short-living SharedLock every second.
-func (v *SchemaVer) HoldSharedLock(ctx context.Context, relockEvery time.Duration) {
+// It uses separate connection to protocol, so it works no matter is
+// lock acquired by this object or not. Version is read under
+// SharedLock, so new version will be sent only after ExclusiveLock used
+// to change it will be released. If protocol doesn't support change
+// notifications then version will be polled every second.
+//
+// Errors while reading version are ignored and reading will be retried.
+func (v *SchemaVer) Watch(ctx context.Context) <-chan Version {
+	ctx = v.untilClose(ctx)
+	c := make(chan Version)
 	v.holdWG.Add(1)
 	go func() {
-		hold := true
+		defer v.holdWG.Done()
+		defer close(c)
+		v.watch(ctx, c)
+	}()
+	return c
+}
+
+func (v *SchemaVer) watch(ctx context.Context, c chan<- Version) {
+	const pollInterval = time.Second
+	backOff := internal.NewWaitBackOff()
+	m, err := v.newManage()
+	for err != nil {
 		select {
-		case <-v.holdQuit:
-			hold = false
-		default:
+		case <-time.After(backOff.NextBackOff()):
+		case <-ctx.Done():
+			return
 		}
-		for hold {
-			v.SharedLock()
+		m, err = v.newManage()
+	}
+	backend := newManageV2(m)
+	defer backend.Close() //nolint:errcheck // Defer.
+
+	var changed <-chan struct{}
+	if w, ok := m.(ManageWatch); ok {
+		changed, _ = w.Watch(ctx)
+	}
+
+	var last Version
+	for {
+		wait := pollInterval
+		ver, err := readVersion(ctx, backend)
+		switch {
+		case err != nil:
+			wait = backOff.NextBackOff()
+		case ver != last:
+			backOff.Reset()
 			select {
-			case <-time.After(relockEvery):
+			case c <- ver:
+				last = ver
 			case <-ctx.Done():
-				hold = false
-			case <-v.holdQuit:
-				hold = false
+				return
 			}
-			v.Unlock()
 		}
-		v.holdWG.Done()
+
+		var poll <-chan time.Time
+		if changed == nil || err != nil {
+			poll = time.After(wait)
+		}
+		select {
+		case _, ok := <-changed:
+			if !ok {
+				changed = nil
+			}
+		case <-poll:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func readVersion(ctx context.Context, backend ManageV2) (Version, error) {
+	err := backend.SharedLockContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	ver, err := backend.GetErr()
+	if errUnlock := backend.UnlockErr(); err == nil {
+		err = errUnlock
+	}
+	return Version(ver), err
+}
+
+// untilClose returns ctx which will be canceled on Close.
+func (v *SchemaVer) untilClose(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	v.holdWG.Add(1)
+	go func() {
+		defer v.holdWG.Done()
+		select {
+		case <-v.holdQuit:
+		case <-ctx.Done():
+		}
+		cancel()
 	}()
+	return ctx
 }
 
 // SharedLock acquire shared lock and return current version.
 //
 // It may be called recursively, under already acquired SharedLock
 // or ExclusiveLock (in this case it'll do nothing).
+//
+// Recursive calls are detected per goroutine: called by another
+// goroutine it'll wait until ExclusiveLock will be released and (just
+// like sync.RWMutex) won't acquire new shared lock while some goroutine
+// is waiting for Exclusive or ExclusiveLock. Lock acquired by Shared or
+// Exclusive in same goroutine is handled like SharedLock or
+// ExclusiveLock. Lock may be released by Unlock called by another
+// goroutine. If goroutine can't be identified (by parsing
+// runtime.Stack) then lock won't be acquired.
+//
+// It panics on error, use SharedLockContext to get error instead.
 func (v *SchemaVer) SharedLock() string {
+	ver, err := v.SharedLockContext(context.Background())
+	if err != nil && !isLockHeld(err) {
+		panic(err)
+	}
+	return ver
+}
+
+// SharedLockContext works like SharedLock but returns error if ctx.Done
+// before lock was acquired or on any other error.
+//
+// If current version doesn't match constraint set by Require then it
+// will return *UnsupportedVersionError or wait according to Policy.
+func (v *SchemaVer) SharedLockContext(ctx context.Context) (string, error) {
+	return v.lockContext(ctx, lockRequest{
+		typ:         LockShared,
+		legacy:      true,
+		lockBackend: v.backend.SharedLockContext,
+	})
+}
+
+// TrySharedLock works like SharedLockContext but returns ErrWouldBlock
+// instead of waiting for a lock. PolicyWait works like PolicyFail.
+//
+// It returns ErrNotSupported if protocol doesn't support it.
+func (v *SchemaVer) TrySharedLock() (string, error) {
+	return v.tryLock(lockRequest{
+		typ:    LockShared,
+		legacy: true,
+		lockBackend: func(context.Context) (err error) {
+			defer recoverErr(&err)
+			if try, ok := v.manage.(ManageTry); ok {
+				return try.TrySharedLock()
+			}
+			return ErrNotSupported
+		},
+	})
+}
+
+// ExclusiveLock acquire exclusive lock and return current version.
+//
+// It may be called recursively, under already acquired ExclusiveLock
+// (in this case it'll do nothing). It returns ErrUnderSharedLock if
+// called under SharedLock acquired by same goroutine (use Upgrade
+// instead).
+//
+// Recursive calls are detected per goroutine: called by another
+// goroutine it'll wait until all locks acquired by other goroutines
+// will be released. Lock acquired by Shared or Exclusive in same
+// goroutine is handled like SharedLock or ExclusiveLock.
+//
+// It panics on error, use ExclusiveLockContext to get error instead.
+func (v *SchemaVer) ExclusiveLock() string {
+	ver, err := v.ExclusiveLockContext(context.Background())
+	if err != nil && !isLockHeld(err) {
+		panic(err)
+	}
+	return ver
+}
+
+// ExclusiveLockContext works like ExclusiveLock but returns error if
+// ctx.Done before lock was acquired or on any other error.
+//
+// If current version doesn't match constraint set by Require then it
+// will return *UnsupportedVersionError or wait according to Policy.
+func (v *SchemaVer) ExclusiveLockContext(ctx context.Context) (string, error) {
+	return v.lockContext(ctx, lockRequest{
+		typ:         LockExclusive,
+		legacy:      true,
+		lockBackend: v.backend.ExclusiveLockContext,
+	})
+}
+
+// TryExclusiveLock works like ExclusiveLockContext but returns
+// ErrWouldBlock instead of waiting for a lock. PolicyWait works like
+// PolicyFail.
+//
+// It returns ErrNotSupported if protocol doesn't support it.
+func (v *SchemaVer) TryExclusiveLock() (string, error) {
+	return v.tryLock(lockRequest{
+		typ:    LockExclusive,
+		legacy: true,
+		lockBackend: func(context.Context) (err error) {
+			defer recoverErr(&err)
+			if try, ok := v.manage.(ManageTry); ok {
+				return try.TryExclusiveLock()
+			}
+			return ErrNotSupported
+		},
+	})
+}
+
+// Lock is a lock acquired by Shared or Exclusive.
+type Lock struct {
+	v        *SchemaVer
+	typ      LockType
+	ver      Version
+	goid     uint64 // Goroutine ID which acquired lock.
+	once     sync.Once
+	released bool // Protected by v.mu.
+}
+
+// Shared acquire shared lock and return it. Returned lock must be
+// released using Release by same or another goroutine.
+//
+// Unlike SharedLock it acquire new lock for each call: all shared locks
+// acquired by Shared, SharedLock and HoldSharedLock share same lock
+// acquired using protocol, which will be released after last of them
+// will be released. It won't acquire new shared lock while some
+// goroutine is waiting for Exclusive or ExclusiveLock, so (just like
+// sync.RWMutex) goroutine must not call it while it holds a shared lock.
+//
+// If current version doesn't match constraint set by Require then it
+// will return *UnsupportedVersionError or wait according to Policy.
+// Returned lock will be nil unless error has LockHeld set.
+func (v *SchemaVer) Shared(ctx context.Context) (*Lock, error) {
+	return v.newLock(ctx, LockShared, v.backend.SharedLockContext)
+}
+
+// Exclusive acquire exclusive lock and return it. Returned lock must be
+// released using Release by same or another goroutine.
+//
+// Unlike ExclusiveLock it will wait until all locks acquired by other
+// goroutines (using Shared, Exclusive, SharedLock, ExclusiveLock or
+// HoldSharedLock) will be released.
+//
+// If current version doesn't match constraint set by Require then it
+// will return *UnsupportedVersionError or wait according to Policy.
+// Returned lock will be nil unless error has LockHeld set.
+func (v *SchemaVer) Exclusive(ctx context.Context) (*Lock, error) {
+	return v.newLock(ctx, LockExclusive, v.backend.ExclusiveLockContext)
+}
+
+func (v *SchemaVer) newLock(ctx context.Context, typ LockType, lockBackend func(context.Context) error) (*Lock, error) {
+	goid, err := internal.GoID()
+	if err != nil {
+		return nil, fmt.Errorf("narada4d: can't detect recursive lock: %w", err)
+	}
+	ver, err := v.lockContext(ctx, lockRequest{typ: typ, goid: goid, lockBackend: lockBackend})
+	if err != nil && !isLockHeld(err) {
+		return nil, err
+	}
+	return &Lock{v: v, typ: typ, ver: Version(ver), goid: goid}, err
+}
+
+// Type returns lock type.
+func (l *Lock) Type() LockType { return l.typ }
+
+// Version returns version at the moment lock was acquired.
+func (l *Lock) Version() Version { return l.ver }
+
+// Release releases lock. Next calls will do nothing and return nil.
+//
+// Lock will be considered released even if error is returned.
+func (l *Lock) Release() (err error) {
+	l.once.Do(func() {
+		l.v.lockIdle()
+		defer l.v.mu.Unlock()
+
+		l.released = true
+		err = l.v.release(false, l.goid)
+	})
+	return err
+}
+
+type lockRequest struct {
+	typ          LockType
+	legacy       bool   // SharedLock or ExclusiveLock, may be recursive.
+	goid         uint64 // Goroutine ID, detected by lockContext or tryLock for legacy.
+	noWait       bool   // Return ErrWouldBlock instead of waiting for other locks.
+	noConstraint bool
+	lockBackend  func(context.Context) error
+}
+
+func (v *SchemaVer) tryLock(req lockRequest) (string, error) {
+	if req.legacy {
+		goid, err := internal.GoID()
+		if err != nil {
+			return "", fmt.Errorf("narada4d: can't detect recursive lock: %w", err)
+		}
+		req.goid = goid
+	}
+
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	var ver string
-	switch v.lockType {
-	case exclusive:
-		v.skipUnlock++
-		ver = v.backend.Get()
-	case shared:
-		v.skipUnlock++
-		ver = v.sharedVer
-	case unlocked:
-		v.backend.SharedLock()
-		v.lockType = shared
-		v.sharedVer = v.backend.Get()
-		ver = v.sharedVer
-	default:
-		panic("never here")
+	req.noWait = true
+	ver, _, _, err := v.lock(context.Background(), req)
+	return ver, err
+}
+
+func (v *SchemaVer) lockContext(ctx context.Context, req lockRequest) (string, error) {
+	if req.legacy {
+		goid, err := internal.GoID()
+		if err != nil {
+			return "", fmt.Errorf("narada4d: can't detect recursive lock: %w", err)
+		}
+		req.goid = goid
+	}
+	ctx, cancel := v.opts.withLockTimeout(ctx)
+	defer cancel()
+
+	var backOff backoff.BackOff
+	waiting := false // Is counted in v.exclusiveWaiting.
+	defer func() {
+		if waiting {
+			v.mu.Lock()
+			v.exclusiveWaiting--
+			v.broadcast()
+			v.mu.Unlock()
+		}
+	}()
+	for {
+		ver, wait, retry, err := func() (ver string, wait <-chan struct{}, retry bool, err error) {
+			err = v.mu.LockContext(ctx)
+			if err != nil {
+				return "", nil, false, err
+			}
+			defer v.mu.Unlock()
+
+			ver, wait, retry, err = v.lock(ctx, req)
+			switch {
+			case wait != nil && req.typ == LockExclusive && !waiting:
+				v.exclusiveWaiting++
+				waiting = true
+				v.broadcast() // Wake up HoldSharedLockYield.
+			case wait == nil && waiting:
+				v.exclusiveWaiting--
+				waiting = false
+				v.broadcast()
+			}
+			return ver, wait, retry, err
+		}()
+
+		var timeout <-chan time.Time
+		switch {
+		case wait != nil:
+		case retry:
+			if backOff == nil {
+				backOff = internal.NewWaitBackOff()
+			}
+			timeout = time.After(backOff.NextBackOff())
+		default:
+			return ver, err
+		}
+		select {
+		case <-wait:
+		case <-timeout:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// lock must be called under v.mu (which will be unlocked while waiting
+// for protocol). It returns wait!=nil if lock can't be acquired because
+// of locks acquired by other goroutines (caller should wait until wait
+// is closed and try again) and retry=true if lock was released because
+// of PolicyWait.
+func (v *SchemaVer) lock(ctx context.Context, req lockRequest) (ver string, wait <-chan struct{}, retry bool, err error) {
+	recursive := req.legacy && v.ownLocks(req.goid) > 0
+	fetched := false
+	switch {
+	case v.acquiring && req.noWait:
+		return "", nil, false, ErrWouldBlock
+	case v.acquiring:
+		return "", v.released, false, nil
+	case recursive && v.lockType == LockShared && req.typ == LockExclusive:
+		return "", nil, false, ErrUnderSharedLock
+	case recursive:
+	case !v.available(req.typ) && req.noWait:
+		return "", nil, false, ErrWouldBlock
+	case !v.available(req.typ):
+		return "", v.released, false, nil
+	case v.lockType == unlocked:
+		err = v.backendLock(ctx, req.typ, req.lockBackend)
+		if err != nil {
+			return "", nil, false, err
+		}
+		ver, err = v.backendGet()
+		if err == nil && req.typ == LockExclusive {
+			err = v.setSkipLock()
+		}
+		if err != nil {
+			_ = v.backendUnlock()
+			v.broadcast()
+			return "", nil, false, err
+		}
+		v.sharedVer = ver
+		fetched = true
+	}
+	if req.legacy {
+		if v.legacyBy == nil {
+			v.legacyBy = make(map[uint64]int)
+		}
+		v.legacy++
+		v.legacyBy[req.goid]++
+	} else {
+		if v.handlesBy == nil {
+			v.handlesBy = make(map[uint64]int)
+		}
+		v.handles++
+		v.handlesBy[req.goid]++
+	}
+
+	if !fetched {
+		ver, err = v.version()
+		if err != nil {
+			_ = v.release(req.legacy, req.goid)
+			return "", nil, false, err
+		}
+	}
+
+	if !req.noConstraint && !v.constraint.Check(Version(ver)) {
+		errUnsupported := &UnsupportedVersionError{Version: Version(ver), Constraint: v.constraint}
+		if v.policy != PolicyReport {
+			_ = v.release(req.legacy, req.goid)
+			return "", nil, v.policy == PolicyWait && !recursive, errUnsupported
+		}
+		errUnsupported.LockHeld = true
+		err = errUnsupported
 	}
 
 	for _, callback := range v.callbacks {
 		callback(ver)
 	}
-	return ver
+	return ver, nil, false, err
 }
 
-// ExclusiveLock acquire exclusive lock and return current version.
+// available must be called under v.mu. It returns true if lock of given
+// type won't conflict with locks acquired by other goroutines.
+func (v *SchemaVer) available(typ LockType) bool {
+	held := v.legacy+v.handles > 0
+	if typ == LockExclusive {
+		return !held
+	}
+	return !(held && v.lockType == LockExclusive) && v.exclusiveWaiting == 0
+}
+
+// version must be called under v.mu.
+func (v *SchemaVer) version() (string, error) {
+	if v.lockType == LockShared {
+		return v.sharedVer, nil
+	}
+	return v.backendGet()
+}
+
+// broadcast must be called under v.mu to wake up goroutines waiting
+// for v.released.
+func (v *SchemaVer) broadcast() {
+	close(v.released)
+	v.released = make(chan struct{})
+}
+
+// release must be called under v.mu. Goroutine ID which acquired lock
+// is used only for Shared and Exclusive.
+func (v *SchemaVer) release(legacy bool, goid uint64) (err error) {
+	switch {
+	case legacy && v.legacy == 0:
+		return fmt.Errorf("can't unlock, %w", ErrNotLocked)
+	case legacy:
+		v.legacy--
+		v.forgetLegacy()
+	default:
+		v.handles--
+		v.handlesBy[goid]--
+		if v.handlesBy[goid] == 0 {
+			delete(v.handlesBy, goid)
+		}
+	}
+	defer v.broadcast()
+
+	if v.legacy+v.handles == 0 && !v.inherited && v.lockType != unlocked {
+		err = v.backendUnlock()
+		if errEnv := v.unsetSkipLock(); err == nil {
+			err = errEnv
+		}
+	}
+	return err
+}
+
+// ownLocks must be called under v.mu. It returns amount of locks
+// acquired by given goroutine using SharedLock, ExclusiveLock, Shared
+// or Exclusive.
+func (v *SchemaVer) ownLocks(goid uint64) int {
+	return v.legacyBy[goid] + v.handlesBy[goid]
+}
+
+// forgetLegacy must be called under v.mu to forget one of SharedLock or
+// ExclusiveLock acquired by current goroutine or by some other goroutine
+// (lock may be released by another goroutine). Current goroutine is
+// detected only if locks are held by several goroutines.
+func (v *SchemaVer) forgetLegacy() {
+	var id uint64
+	for id = range v.legacyBy {
+		break
+	}
+	if len(v.legacyBy) > 1 {
+		if goid, err := internal.GoID(); err == nil && v.legacyBy[goid] > 0 {
+			id = goid
+		}
+	}
+	v.legacyBy[id]--
+	if v.legacyBy[id] == 0 {
+		delete(v.legacyBy, id)
+	}
+}
+
+// Upgrade converts SharedLock into ExclusiveLock and returns current
+// version and true if version was changed since SharedLock. It'll wait
+// until all shared locks acquired by other goroutines (using Shared,
+// SharedLock or HoldSharedLock) will be released, so two goroutines
+// must not upgrade their SharedLock at once. Constraint set by Require
+// is not checked.
 //
-// It may be called recursively, under already acquired ExclusiveLock
-// (in this case it'll do nothing).
-func (v *SchemaVer) ExclusiveLock() string {
-	v.mu.Lock()
+// It must be called by goroutine which has acquired SharedLock,
+// otherwise it returns ErrNotLocked.
+//
+// Lock is converted non-atomically (by releasing shared lock and
+// acquiring exclusive one) because of protocols limitations, so
+// version may be changed by someone else in between.
+//
+// It does nothing if called under ExclusiveLock. If exclusive lock
+// can't be acquired then it'll wait to re-acquire shared lock before
+// returning error. If that's not possible then lock will be released,
+// returned error will match ErrLockLost and further Unlock calls will
+// return ErrNotLocked.
+func (v *SchemaVer) Upgrade(ctx context.Context) (ver string, changed bool, err error) {
+	goid, err := internal.GoID()
+	if err != nil {
+		return "", false, fmt.Errorf("narada4d: can't upgrade: %w", err)
+	}
+	ctx, cancel := v.opts.withLockTimeout(ctx)
+	defer cancel()
+
+	waiting := false // Is counted in v.exclusiveWaiting.
+	defer func() {
+		if waiting {
+			v.mu.Lock()
+			v.exclusiveWaiting--
+			v.broadcast()
+			v.mu.Unlock()
+		}
+	}()
+	for {
+		err = v.mu.LockContext(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		wait := v.released
+		own := v.legacyBy[goid]
+		if own == 0 || !v.acquiring && v.handles == v.handlesBy[goid] && v.legacy == own {
+			break
+		}
+		if !waiting {
+			v.exclusiveWaiting++
+			waiting = true
+			v.broadcast() // Wake up HoldSharedLockYield.
+		}
+		v.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+	}
 	defer v.mu.Unlock()
 
-	switch v.lockType {
-	case exclusive:
-		v.skipUnlock++
-	case shared:
-		panic("unable to acquire exclusive lock under shared lock")
-	case unlocked:
-		v.backend.ExclusiveLock()
-		v.lockType = exclusive
-		v.setSkipLock()
-	default:
-		panic("never here")
+	switch {
+	case v.legacyBy[goid] == 0:
+		return "", false, fmt.Errorf("can't upgrade, %w", ErrNotLocked)
+	case v.lockType == LockExclusive:
+		ver, err = v.version()
+		return ver, false, err
+	}
+
+	prevVer := v.sharedVer
+	_ = v.backendUnlock()
+	err = v.backendLock(ctx, LockExclusive, v.backend.ExclusiveLockContext)
+	if err == nil {
+		err = v.setSkipLock()
+	}
+	if err == nil {
+		ver, err = v.backendGet()
+	}
+	if err != nil {
+		if v.lockType != unlocked {
+			_ = v.backendUnlock()
+		}
+		if errRelock := v.relock(LockShared); errRelock != nil {
+			return "", false, fmt.Errorf("can't upgrade: %v, %w", err, errRelock)
+		}
+		return "", false, err
 	}
 
-	ver := v.backend.Get()
 	for _, callback := range v.callbacks {
 		callback(ver)
 	}
-	return ver
+	return ver, ver != prevVer, nil
+}
+
+// Downgrade converts ExclusiveLock into SharedLock. It'll be done
+// atomically if protocol supports this, otherwise version may be
+// changed by someone else in between (use Get to check it).
+//
+// If shared lock can't be acquired then lock will be released,
+// returned error will match ErrLockLost and further Unlock calls will
+// return ErrNotLocked.
+func (v *SchemaVer) Downgrade() (err error) {
+	v.lockIdle()
+	defer v.mu.Unlock()
+
+	switch {
+	case v.legacy == 0:
+		return fmt.Errorf("can't downgrade, %w", ErrNotLocked)
+	case v.lockType != LockExclusive:
+		return fmt.Errorf("can't downgrade, %w", ErrRequireExclusive)
+	case v.inherited:
+		return fmt.Errorf("can't downgrade lock acquired by parent process: %w", ErrNotSupported)
+	}
+
+	if d, ok := v.manage.(ManageDowngrade); ok {
+		ctx, held := v.lockCtx, time.Since(v.lockedAt)
+		err = func() (err error) {
+			defer recoverErr(&err)
+			return d.Downgrade()
+		}()
+		v.observer.LockReleased(ctx, LockExclusive, held, err)
+		v.backendError(ctx, "Downgrade", err)
+		if err == nil {
+			v.observer.LockRequested(ctx, LockShared)
+			v.observer.LockAcquired(ctx, LockShared, 0, nil)
+			v.lockType, v.lockedAt = LockShared, time.Now()
+			v.sharedVer, err = v.backendGet()
+		}
+		if err != nil {
+			_ = v.backendUnlock()
+		}
+	} else {
+		_ = v.backendUnlock()
+	}
+	if errEnv := v.unsetSkipLock(); err == nil {
+		err = errEnv
+	}
+	if v.lockType == unlocked {
+		err = v.relock(LockShared)
+	}
+	v.broadcast()
+	return err
+}
+
+// relock must be called under v.mu after releasing lock acquired by
+// SharedLock or ExclusiveLock to acquire it again (it'll wait as long
+// as needed). If lock can't be acquired then SharedLock and
+// ExclusiveLock will be considered released and returned error will
+// match ErrLockLost.
+func (v *SchemaVer) relock(typ LockType) (err error) {
+	lockBackend := v.backend.SharedLockContext
+	if typ == LockExclusive {
+		lockBackend = v.backend.ExclusiveLockContext
+	}
+	err = v.backendLock(context.Background(), typ, lockBackend)
+	if err == nil {
+		v.sharedVer, err = v.backendGet()
+		if err != nil {
+			_ = v.backendUnlock()
+		}
+	}
+	if err != nil {
+		v.legacy, v.legacyBy = 0, nil
+		v.broadcast()
+		return fmt.Errorf("%w: failed to re-acquire %s lock: %v", ErrLockLost, typ, err)
+	}
+	return nil
+}
+
+func isLockHeld(err error) bool {
+	var errUnsupported *UnsupportedVersionError
+	return errors.As(err, &errUnsupported) && errUnsupported.LockHeld
 }
 
 // Unlock release lock acquired using SharedLock or ExclusiveLock.
@@ -263,46 +985,403 @@ func (v *SchemaVer) ExclusiveLock() string {
 // When called to unlock previous SharedLock or ExclusiveLock
 // which did nothing (because lock was already acquired) then it
 // will do nothing too.
+//
+// It panics on error, use UnlockErr to get error instead.
 func (v *SchemaVer) Unlock() {
-	v.mu.Lock()
+	if err := v.UnlockErr(); err != nil {
+		panic(err)
+	}
+}
+
+// UnlockErr works like Unlock but returns error instead of panic.
+//
+// Lock will be considered released even if error is returned.
+func (v *SchemaVer) UnlockErr() error {
+	v.lockIdle()
 	defer v.mu.Unlock()
 
-	if v.lockType == unlocked {
-		panic("can't unlock, no lock acquired")
-	}
-	if v.skipUnlock > 0 {
-		v.skipUnlock--
-	} else {
-		v.backend.Unlock()
-		v.lockType = unlocked
-		v.unsetSkipLock()
-	}
+	return v.release(true, 0)
 }
 
 // Get returns current version.
 //
 // It must be called under SharedLock or ExclusiveLock.
+//
+// It panics on error, use GetErr to get error instead.
 func (v *SchemaVer) Get() string {
-	v.mu.Lock()
+	ver, err := v.GetErr()
+	if err != nil {
+		panic(err)
+	}
+	return ver
+}
+
+// GetErr works like Get but returns error instead of panic.
+func (v *SchemaVer) GetErr() (string, error) {
+	v.lockIdle()
 	defer v.mu.Unlock()
 
 	if v.lockType == unlocked {
-		panic("require SharedLock or ExclusiveLock")
+		return "", fmt.Errorf("%w: require SharedLock or ExclusiveLock", ErrNotLocked)
 	}
-	return v.backend.Get()
+	return v.backendGet()
 }
 
 // Set change current version.
 //
-// It must be called under ExclusiveLock.
+// It must be called under ExclusiveLock. Version must be valid
+// (see ParseVersion).
+//
+// It panics on error, use SetErr to get error instead.
 func (v *SchemaVer) Set(ver string) {
+	if err := v.SetErr(ver); err != nil {
+		panic(err)
+	}
+}
+
+// SetErr works like Set but returns error instead of panic.
+func (v *SchemaVer) SetErr(ver string) error {
+	v.lockIdle()
+	defer v.mu.Unlock()
+
+	if v.lockType != LockExclusive {
+		return ErrRequireExclusive
+	}
+	if _, err := ParseVersion(ver); err != nil {
+		return err
+	}
+	return v.backendSet(ver)
+}
+
+// SetIf works like SetErr but changes version only if current version
+// is expected, otherwise it returns *VersionConflictError with current
+// version.
+//
+// It's atomic if protocol supports this (see ManageSetIf), this
+// protects from concurrent changes made by processes which share lock
+// (see EnvSkipLock).
+func (v *SchemaVer) SetIf(expected, next Version) error {
+	v.lockIdle()
+	defer v.mu.Unlock()
+
+	if v.lockType != LockExclusive {
+		return ErrRequireExclusive
+	}
+	if _, err := ParseVersion(string(next)); err != nil {
+		return err
+	}
+	return v.backendSetIf(string(expected), string(next))
+}
+
+// Note returns note set by Migrate about last started migration: it's
+// from and to versions and an error if it has failed. Note may be
+// outdated unless version is BadVersion, it helps to find out why data
+// schema is dirty (e.g. if process was killed during migration).
+//
+// It must be called under SharedLock or ExclusiveLock. It returns
+// ErrNotSupported if protocol doesn't support notes (see ManageNote).
+func (v *SchemaVer) Note() (note string, err error) {
+	v.lockIdle()
+	defer v.mu.Unlock()
+
+	m, ok := v.manage.(ManageNote)
+	switch {
+	case v.lockType == unlocked:
+		return "", fmt.Errorf("%w: require SharedLock or ExclusiveLock", ErrNotLocked)
+	case !ok:
+		return "", ErrNotSupported
+	}
+	err = func() (err error) {
+		defer recoverErr(&err)
+		note, err = m.Note()
+		return err
+	}()
+	v.backendError(v.lockCtx, "Note", err)
+	return note, err
+}
+
+// setNote sets note if protocol supports it (see ManageNote).
+func (v *SchemaVer) setNote(note string) error {
+	v.lockIdle()
+	defer v.mu.Unlock()
+
+	m, ok := v.manage.(ManageNote)
+	switch {
+	case v.lockType != LockExclusive:
+		return ErrRequireExclusive
+	case !ok:
+		return nil
+	}
+	err := func() (err error) {
+		defer recoverErr(&err)
+		return m.SetNote(note)
+	}()
+	v.backendError(v.lockCtx, "SetNote", err)
+	return err
+}
+
+var lockOp = map[LockType]string{ //nolint:gochecknoglobals // Const.
+	LockShared:    "SharedLock",
+	LockExclusive: "ExclusiveLock",
+}
+
+// backendLock must be called under v.mu. It unlocks v.mu while waiting
+// for lock, other goroutines will wait until lock will be acquired
+// meanwhile (see lockIdle).
+func (v *SchemaVer) backendLock(ctx context.Context, typ LockType, lockBackend func(context.Context) error) error {
+	observer := v.observer
+	v.acquiring = true
+	v.mu.Unlock()
+
+	start := time.Now()
+	observer.LockRequested(ctx, typ)
+	err := lockBackend(ctx)
+	observer.LockAcquired(ctx, typ, time.Since(start), err)
+
+	v.mu.Lock()
+	v.acquiring = false
+	v.broadcast()
+	if err != nil {
+		v.backendError(ctx, lockOp[typ], err)
+		return err
+	}
+	v.lockType, v.lockCtx, v.lockedAt = typ, ctx, time.Now()
+	select { // Drop error about previous lock.
+	case <-v.lost:
+	default:
+	}
+	if p, ok := v.manage.(ManagePing); ok {
+		v.pingStop = make(chan struct{})
+		go v.ping(p, v.pingStop)
+	}
+	return nil
+}
+
+// lockIdle locks v.mu and waits until lock won't be acquired using
+// protocol by other goroutine.
+func (v *SchemaVer) lockIdle() {
+	v.mu.Lock()
+	for v.acquiring {
+		wait := v.released
+		v.mu.Unlock()
+		<-wait
+		v.mu.Lock()
+	}
+}
+
+// backendUnlock must be called under v.mu.
+func (v *SchemaVer) backendUnlock() error {
+	if v.pingStop != nil {
+		close(v.pingStop)
+		v.pingStop = nil
+	}
+	err := v.backend.UnlockErr()
+	v.observer.LockReleased(v.lockCtx, v.lockType, time.Since(v.lockedAt), err)
+	v.backendError(v.lockCtx, "Unlock", err)
+	v.lockType, v.lockCtx = unlocked, context.Background()
+	return err
+}
+
+// ping checks lock acquired using protocol is still held until stop.
+func (v *SchemaVer) ping(p ManagePing, stop <-chan struct{}) {
+	ticker := time.NewTicker(v.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		select {
+		case v.mu <- struct{}{}:
+		case <-stop:
+			return
+		}
+		select {
+		case <-stop: // Lock was released while we were waiting for v.mu.
+			v.mu.Unlock()
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), v.opts.PingInterval) // Lock may be used after lockCtx.Done.
+		err := func() (err error) {
+			defer recoverErr(&err)
+			return p.Ping(ctx)
+		}()
+		cancel()
+		v.backendError(v.lockCtx, "Ping", err)
+		if err != nil { // Send under v.mu to not send after next lock.
+			err = fmt.Errorf("%w: %v", ErrLockLost, err)
+			select {
+			case v.lost <- err:
+			default:
+			}
+		}
+		v.mu.Unlock()
+
+		if err != nil {
+			v.opts.Logf("narada4d: %v", err)
+			return
+		}
+	}
+}
+
+// LockLost returns channel which will receive error matching
+// ErrLockLost if lock acquired using protocol will be released without
+// Unlock (e.g. because connection to database was lost). Lock is
+// checked every second (see WithPingInterval) while it's held if
+// protocol supports this (see ManagePing).
+//
+// Lock should be released using Unlock as usually after receiving
+// error. Error will be dropped if channel isn't read before next lock
+// will be acquired using protocol. Channel is never closed.
+func (v *SchemaVer) LockLost() <-chan error {
+	return v.lost
+}
+
+// backendGet must be called under v.mu.
+func (v *SchemaVer) backendGet() (string, error) {
+	start := time.Now()
+	ver, err := v.backend.GetErr()
+	v.observer.Get(v.lockCtx, Version(ver), time.Since(start), err)
+	v.backendError(v.lockCtx, "Get", err)
+	return ver, err
+}
+
+// backendSet must be called under v.mu.
+func (v *SchemaVer) backendSet(ver string) error {
+	start := time.Now()
+	err := v.backend.SetErr(ver)
+	v.observer.Set(v.lockCtx, Version(ver), time.Since(start), err)
+	v.backendError(v.lockCtx, "Set", err)
+	return err
+}
+
+// backendSetIf must be called under v.mu.
+func (v *SchemaVer) backendSetIf(expected, ver string) error {
+	m, ok := v.manage.(ManageSetIf)
+	if !ok {
+		actual, err := v.backendGet()
+		if err == nil && actual != expected {
+			err = &VersionConflictError{Expected: Version(expected), Actual: Version(actual)}
+		}
+		if err != nil {
+			return err
+		}
+		return v.backendSet(ver)
+	}
+
+	start := time.Now()
+	err := func() (err error) {
+		defer recoverErr(&err)
+		return m.SetIf(expected, ver)
+	}()
+	v.observer.Set(v.lockCtx, Version(ver), time.Since(start), err)
+	v.backendError(v.lockCtx, "SetIf", err)
+	return err
+}
+
+func (v *SchemaVer) backendError(ctx context.Context, op string, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrWouldBlock), errors.Is(err, ErrNotSupported), errors.Is(err, ErrVersionConflict):
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+	default:
+		v.observer.BackendError(ctx, op, err)
+	}
+}
+
+// Require sets constraint (see Constraint) for versions supported by
+// application and policy used by SharedLock and ExclusiveLock when
+// current version doesn't match it. Empty constraint matches any
+// version.
+//
+// Constraint is checked before calling callbacks registered by
+// AddCallback, callbacks won't be called if lock was released because
+// of constraint.
+func (v *SchemaVer) Require(constraint string, policy Policy) error {
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.constraint = c
+	v.policy = policy
+	return nil
+}
+
+// WaitFor will repeatedly acquire SharedLock, get current version and
+// release lock until current version satisfies predicate or ctx.Done.
+// It returns last seen version. Constraint.Check may be used as
+// predicate.
+//
+// Constraint set by Require is ignored by WaitFor, but callbacks
+// registered by AddCallback will be called on each attempt.
+//
+// It returns ErrLocked if called under SharedLock, ExclusiveLock,
+// Shared or Exclusive acquired by same goroutine because version can't
+// be changed while lock is acquired.
+func (v *SchemaVer) WaitFor(ctx context.Context, predicate func(Version) bool) (Version, error) {
+	backOff := internal.NewWaitBackOff()
+	for {
+		ver, err := v.sharedGet(ctx)
+		if err != nil || predicate(ver) {
+			return ver, err
+		}
+
+		select {
+		case <-time.After(backOff.NextBackOff()):
+		case <-ctx.Done():
+			return ver, ctx.Err()
+		}
+	}
+}
+
+func (v *SchemaVer) sharedGet(ctx context.Context) (Version, error) {
+	goid, err := internal.GoID()
+	if err != nil {
+		return "", fmt.Errorf("narada4d: can't detect recursive lock: %w", err)
+	}
+	err = v.mu.LockContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	locked := v.ownLocks(goid) > 0 || v.inherited
+	v.mu.Unlock()
+	if locked {
+		return "", fmt.Errorf("can't wait for version, %w", ErrLocked)
+	}
+
+	ver, err := v.lockContext(ctx, lockRequest{
+		typ:          LockShared,
+		goid:         goid,
+		noConstraint: true,
+		lockBackend:  v.backend.SharedLockContext,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return Version(ver), v.release(false, goid)
+}
+
+// SetObserver sets Observer which will be notified about locks and
+// other operations with protocol. Nil observer resets it to default
+// NopObserver.
+func (v *SchemaVer) SetObserver(observer Observer) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	if v.lockType != exclusive {
-		panic("require ExclusiveLock")
+	if observer == nil {
+		observer = NopObserver{}
 	}
-	v.backend.Set(ver)
+	v.observer = observer
 }
 
 // AddCallback registers user-provided function which will be
@@ -322,14 +1401,16 @@ func (v *SchemaVer) AddCallback(callback func(string)) {
 	v.callbacks = append(v.callbacks, callback)
 }
 
-// Close release any resources used to manage schema version.
+// Close release any resources used to manage schema version. It waits
+// until lock abandoned on ctx.Done by protocol without ManageContext
+// support will be acquired and released.
 //
 // No other methods should be called after Close.
 func (v *SchemaVer) Close() error {
 	close(v.holdQuit)
 	v.holdWG.Wait()
 
-	v.mu.Lock()
+	v.lockIdle()
 	defer v.mu.Unlock()
 	return v.backend.Close()
 }
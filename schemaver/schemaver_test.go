@@ -1,8 +1,11 @@
 package schemaver_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"net/url"
 	"os"
 	"sync"
@@ -25,6 +28,29 @@ func init() {
 		New:        mockNew,
 		Initialize: mockInitialize,
 	})
+	schemaver.RegisterProtocol("test-basic", schemaver.Backend{
+		New: func(loc *url.URL) (schemaver.Manage, error) {
+			m, err := mockNew(loc)
+			return mockManageBasic{m}, err
+		},
+		Initialize: mockInitialize,
+	})
+	schemaver.RegisterProtocol("test-token", schemaver.Backend{
+		New: func(loc *url.URL) (schemaver.Manage, error) {
+			m, err := mockNew(loc)
+			return mockManageToken{m.(*mockManage)}, err
+		},
+		Initialize: mockInitialize,
+	})
+	schemaver.RegisterProtocol("test-options", schemaver.Backend{
+		NewWithOptions: func(loc *url.URL, opts schemaver.Options) (schemaver.Manage, error) {
+			mu.Lock()
+			gotOpts = opts
+			mu.Unlock()
+			return mockNew(loc)
+		},
+		Initialize: mockInitialize,
+	})
 }
 
 func TestRegisterProtocol(tt *testing.T) {
@@ -48,6 +74,62 @@ func TestRegisterProtocol(tt *testing.T) {
 	}, `can't register protocol "new" with nil implementation`)
 }
 
+func TestRegistry(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+	var r schemaver.Registry
+	backend := schemaver.Backend{New: mockNew, Initialize: mockInitialize}
+
+	// - empty registry, unknown protocol
+	t.DeepEqual(r.Protocols(), []string{})
+	_, err := r.Lookup("test")
+	t.Err(err, schemaver.ErrUnknownProtocol)
+	_, err = r.NewAt("test://")
+	t.Err(err, schemaver.ErrUnknownProtocol)
+	t.Err(r.Initialize("test://"), schemaver.ErrUnknownProtocol)
+
+	// - register protocol already registered in DefaultRegistry, success
+	t.Nil(r.Register("test", backend))
+	t.Nil(r.Register("b", backend))
+	t.Err(r.Register("test", backend), schemaver.ErrAlreadyRegistered)
+	t.Match(r.Register("new", schemaver.Backend{New: mockNew}), `nil implementation`)
+	t.DeepEqual(r.Protocols(), []string{"b", "test"})
+	_, err = r.Lookup("test")
+	t.Nil(err)
+	_, err = r.NewAt("test://")
+	t.Nil(err)
+	_, err = r.NewAt("test-basic://")
+	t.Err(err, schemaver.ErrUnknownProtocol)
+	t.Nil(r.Initialize("test://"))
+	t.Err(r.Initialize("test:///ready"), errInitialized)
+
+	// - alias, registered before protocol
+	t.Nil(r.Alias("a", "test"))
+	t.Nil(r.Alias("c", "d"))
+	t.Err(r.Alias("a", "b"), schemaver.ErrAlreadyRegistered)
+	t.Err(r.Alias("test", "b"), schemaver.ErrAlreadyRegistered)
+	t.Err(r.Register("a", backend), schemaver.ErrAlreadyRegistered)
+	_, err = r.Lookup("c")
+	t.Err(err, schemaver.ErrUnknownProtocol)
+	t.Nil(r.Register("d", backend))
+	_, err = r.Lookup("c")
+	t.Nil(err)
+	t.DeepEqual(r.Protocols(), []string{"b", "d", "test"})
+
+	// - NewAt using alias, NARADA4D_SKIP_LOCK using protocol
+	os.Setenv(schemaver.EnvSkipLock, "test:///path")
+	v, err := r.NewAt("a:///path")
+	t.Nil(err)
+	defer v.Close()
+	t.Equal(v.ExclusiveLock(), "42")
+	v.Unlock()
+	t.Equal(ex, 0)
+
+	// - DefaultRegistry has aliases
+	t.Err(schemaver.DefaultRegistry.Alias("mariadb", "test"), schemaver.ErrAlreadyRegistered)
+	t.Err(schemaver.DefaultRegistry.Alias("postgresql", "test"), schemaver.ErrAlreadyRegistered)
+}
+
 func TestLocation(tt *testing.T) {
 	t := check.T(tt)
 	reset()
@@ -99,8 +181,59 @@ func TestNew(tt *testing.T) {
 	t.Nil(err)
 }
 
+func TestNewWithManage(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+	calls := 0
+	newManage := func(opts schemaver.Options) (schemaver.Manage, error) {
+		calls++
+		t.Equal(opts.LockTimeout, testSecond)
+		return &mockManage{}, nil
+	}
+
+	// - unknown protocol, error
+	_, err := schemaver.NewWithManage("unknown://", newManage)
+	t.Err(err, schemaver.ErrUnknownProtocol)
+	t.Zero(calls)
+
+	// - newManage error, error
+	_, err = schemaver.NewWithManage("test://", func(schemaver.Options) (schemaver.Manage, error) {
+		return nil, errInvalid
+	})
+	t.Err(err, errInvalid)
+
+	// - success, options passed to newManage
+	v, err := schemaver.NewWithManage("test://", newManage, schemaver.WithLockTimeout(testSecond))
+	t.Nil(err)
+	defer v.Close()
+	t.Equal(calls, 1)
+	t.Equal(v.SharedLock(), "42")
+	v.Unlock()
+
+	// - Watch, newManage called again
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.Equal(<-v.Watch(ctx), schemaver.Version("42"))
+	t.Equal(calls, 2)
+
+	// - NARADA4D_SKIP_LOCK matches location
+	os.Setenv(schemaver.EnvSkipLock, "test://")
+	v2, err := schemaver.NewWithManage("test://", newManage, schemaver.WithLockTimeout(testSecond))
+	t.Nil(err)
+	defer v2.Close()
+	mu.Lock()
+	locks := sh
+	mu.Unlock()
+	t.Equal(v2.SharedLock(), "42")
+	v2.Unlock()
+	mu.Lock()
+	t.Equal(sh, locks)
+	mu.Unlock()
+}
+
 // - SH/EX (with backend, return version), UN (with backend).
-// - NARADA_SKIP_LOCK=1, SH/EX (no backend, return version), UN (no backend).
+// - NARADA_SKIP_LOCK=test://, SH/EX (no backend, return version), UN (no backend).
+// - NARADA_SKIP_LOCK=1 (legacy, refused), SH/EX (with backend), UN (with backend).
 func TestShExLock(tt *testing.T) {
 	t := check.T(tt)
 	reset()
@@ -112,8 +245,10 @@ func TestShExLock(tt *testing.T) {
 	}{
 		{false, "", true},
 		{true, "", true},
-		{true, "1", false},
-		{true, "anything", false},
+		{true, "1", true},
+		{true, "anything", true},
+		{true, "test://", false},
+		{true, "1 test:// anything", false},
 	}
 
 	for _, c := range cases {
@@ -145,6 +280,549 @@ func TestShExLock(tt *testing.T) {
 	}
 }
 
+func TestSkipLockToken(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+	logger := make(testLogger, 1)
+	counters := func() []int { mu.Lock(); defer mu.Unlock(); return []int{sh, ex, un} }
+
+	v, err := schemaver.NewAt("test-token://")
+	t.Nil(err)
+	defer v.Close()
+	id := v.Location().ID()
+
+	// - EX, EnvSkipLock contains token
+	t.Equal(v.ExclusiveLock(), "42")
+	t.Equal(os.Getenv(schemaver.EnvSkipLock), id+"=token1")
+
+	// - child: valid token, SH/EX (no backend), UN (no backend)
+	v2, err := schemaver.NewAt("test-token://")
+	t.Nil(err)
+	t.True(v2.Inherited())
+	t.Equal(v2.SharedLock(), "42")
+	v2.Unlock()
+	t.Equal(v2.ExclusiveLock(), "42")
+	v2.Unlock()
+	t.Nil(v2.Close())
+	t.DeepEqual(counters(), []int{0, 1, 0})
+
+	// - UN, token is no longer valid
+	v.Unlock()
+	t.Equal(os.Getenv(schemaver.EnvSkipLock), "")
+	t.DeepEqual(counters(), []int{0, 1, 1})
+
+	// - child: invalid token, SH (with backend), UN (with backend)
+	for _, env := range []string{
+		id + "=token1",              // Stale.
+		id + "=forged",              // Forged.
+		id,                          // Absent.
+		"test-token://",             // Legacy location.
+		"1",                         // Legacy.
+		"test-token:///other=token", // Other location.
+	} {
+		os.Setenv(schemaver.EnvSkipLock, env)
+		v2, err := schemaver.NewAt("test-token://", schemaver.WithLogger(logger))
+		t.Nil(err)
+		t.False(v2.Inherited(), env)
+		old := counters()
+		t.Equal(v2.SharedLock(), "42")
+		v2.Unlock()
+		t.DeepEqual(counters(), []int{old[0] + 1, old[1], old[2] + 1}, env)
+		t.Nil(v2.Close())
+		select {
+		case msg := <-logger:
+			t.Match(msg, `ignore NARADA4D_SKIP_LOCK entry for test-token:.*invalid skip lock token`, env)
+		default:
+			t.True(env == "1" || env == "test-token:///other=token", env)
+		}
+	}
+}
+
+func TestLockContext(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+
+	// - SH/EX with canceled ctx, error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = v.SharedLockContext(ctx)
+	t.Err(err, context.Canceled)
+	_, err = v.ExclusiveLockContext(ctx)
+	t.Err(err, context.Canceled)
+	t.Equal(sh, 0)
+	t.Equal(ex, 0)
+
+	// - SH/EX (with backend), UN (with backend)
+	ctx = context.Background()
+	ver, err := v.SharedLockContext(ctx)
+	t.Nil(err)
+	t.Equal(ver, "42")
+	v.Unlock()
+	ver, err = v.ExclusiveLockContext(ctx)
+	t.Nil(err)
+	t.Equal(ver, "42")
+	v.Unlock()
+	t.Equal(un, 2)
+
+	// - SH (blocked until ctx.Done), error, (backend lock released in background)
+	// - SH (wait for background release), UN
+	reset()
+	block = make(chan struct{})
+	ctx, cancel = context.WithTimeout(context.Background(), testSecond/10)
+	defer cancel()
+	_, err = v.SharedLockContext(ctx)
+	t.Err(err, context.DeadlineExceeded)
+	time.AfterFunc(testSecond/10, func() { close(block) })
+	t.Equal(v.SharedLock(), "42")
+	mu.Lock()
+	t.Equal(sh, 2)
+	t.Equal(un, 1)
+	mu.Unlock()
+	v.Unlock()
+
+	// - SH (blocked until ctx.Done), error, Close (wait for background release)
+	reset()
+	block = make(chan struct{})
+	ctx, cancel = context.WithTimeout(context.Background(), testSecond/10)
+	defer cancel()
+	_, err = v.SharedLockContext(ctx)
+	t.Err(err, context.DeadlineExceeded)
+	time.AfterFunc(testSecond/10, func() { close(block) })
+	t.Nil(v.Close())
+	mu.Lock()
+	t.Equal(sh, 1)
+	t.Equal(un, 1)
+	mu.Unlock()
+}
+
+func TestTryLock(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+
+	// - TrySH/TryEX (with backend), UN (with backend)
+	ver, err := v.TrySharedLock()
+	t.Nil(err)
+	t.Equal(ver, "42")
+	v.Unlock()
+	ver, err = v.TryExclusiveLock()
+	t.Nil(err)
+	t.Equal(ver, "42")
+	v.Unlock()
+	t.DeepEqual([]int{sh, ex, un}, []int{1, 1, 2})
+
+	// - TrySH/TryEX (backend would block), error
+	block = make(chan struct{})
+	_, err = v.TrySharedLock()
+	t.Err(err, schemaver.ErrWouldBlock)
+	_, err = v.TryExclusiveLock()
+	t.Err(err, schemaver.ErrWouldBlock)
+
+	// - SH (blocked in other goroutine), TrySH (would block), UN
+	done := make(chan struct{})
+	go func() { v.SharedLock(); close(done) }()
+	time.Sleep(testSecond / 10)
+	_, err = v.TrySharedLock()
+	t.Err(err, schemaver.ErrWouldBlock)
+	// - other methods are not blocked while waiting for protocol
+	t.Nil(v.Require("", schemaver.PolicyFail))
+	close(block)
+	<-done
+	// - TrySH (no backend), TryEX (under shared lock), error
+	_, err = v.TrySharedLock()
+	t.Nil(err)
+	_, err = v.TryExclusiveLock()
+	t.Err(err, schemaver.ErrUnderSharedLock)
+	v.Unlock()
+	v.Unlock()
+	t.DeepEqual([]int{sh, ex, un}, []int{2, 1, 3})
+}
+
+func TestLockHandles(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	ctx := context.Background()
+	counters := func() []int { mu.Lock(); defer mu.Unlock(); return []int{sh, ex, un} }
+	acquired := func(c <-chan *schemaver.Lock) bool {
+		select {
+		case <-c:
+			return true
+		case <-time.After(testSecond / 10):
+			return false
+		}
+	}
+
+	// - Shared, Shared (no backend), Release, Release (with backend), Release
+	l1, err := v.Shared(ctx)
+	t.Nil(err)
+	t.Equal(l1.Type(), schemaver.LockShared)
+	t.Equal(l1.Version(), schemaver.Version("42"))
+	l2, err := v.Shared(ctx)
+	t.Nil(err)
+	t.Nil(l1.Release())
+	t.DeepEqual(counters(), []int{1, 0, 0})
+	t.Nil(l2.Release())
+	t.DeepEqual(counters(), []int{1, 0, 1})
+	t.Nil(l2.Release())
+	t.DeepEqual(counters(), []int{1, 0, 1})
+
+	// - Shared, Exclusive (wait), Shared (wait), Release, (Exclusive), Release, (Shared)
+	reset()
+	l1, err = v.Shared(ctx)
+	t.Nil(err)
+	exc := make(chan *schemaver.Lock)
+	go func() { l, _ := v.Exclusive(ctx); exc <- l }()
+	t.False(acquired(exc))
+	shc := make(chan *schemaver.Lock)
+	go func() { l, _ := v.Shared(ctx); shc <- l }()
+	t.False(acquired(shc))
+	ctxTimeout, cancel := context.WithTimeout(ctx, testSecond/10)
+	defer cancel()
+	ver, err := v.SharedLockContext(ctxTimeout) // Recursive under own Shared.
+	t.Nil(err)
+	t.Equal(ver, "42")
+	v.Unlock()
+	t.DeepEqual(counters(), []int{1, 0, 0})
+	t.Nil(l1.Release())
+	l2 = <-exc
+	t.Equal(l2.Type(), schemaver.LockExclusive)
+	t.DeepEqual(counters(), []int{1, 1, 1})
+	t.False(acquired(shc))
+	t.Nil(v.SetErr("43"))
+	t.Nil(l2.Release())
+	l1 = <-shc
+	t.Equal(l1.Version(), schemaver.Version("43"))
+	t.Nil(l1.Release())
+	t.DeepEqual(counters(), []int{2, 1, 3})
+
+	// - SharedLock, Exclusive (canceled), Shared, Exclusive (wait), Unlock, (Exclusive)
+	reset()
+	v.SharedLock()
+	ctxTimeout, cancel = context.WithTimeout(ctx, testSecond/10)
+	defer cancel()
+	_, err = v.Exclusive(ctxTimeout)
+	t.Err(err, context.DeadlineExceeded)
+	l1, err = v.Shared(ctx)
+	t.Nil(err)
+	t.Nil(l1.Release())
+	go func() { l, _ := v.Exclusive(ctx); exc <- l }()
+	t.False(acquired(exc))
+	v.Unlock()
+	l2 = <-exc
+	// - TrySH, TryEX (would block), Release
+	_, err = v.TrySharedLock()
+	t.Err(err, schemaver.ErrWouldBlock)
+	_, err = v.TryExclusiveLock()
+	t.Err(err, schemaver.ErrWouldBlock)
+	t.Nil(l2.Release())
+	t.DeepEqual(counters(), []int{1, 1, 2})
+
+	// - EnvSkipLock: Exclusive, Shared (wait), Release, (Shared, no backend)
+	reset()
+	os.Setenv(schemaver.EnvSkipLock, "test://")
+	v, err = schemaver.New()
+	t.Nil(err)
+	l1, err = v.Exclusive(ctx)
+	t.Nil(err)
+	go func() { l, _ := v.Shared(ctx); shc <- l }()
+	t.False(acquired(shc))
+	t.Nil(l1.Release())
+	t.Nil((<-shc).Release())
+	t.DeepEqual(counters(), []int{0, 0, 0})
+}
+
+func TestLockHandlesRecursive(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	ctx := context.Background()
+	counters := func() []int { mu.Lock(); defer mu.Unlock(); return []int{sh, ex, un} }
+
+	// - Exclusive, SH, SHContext, EX (no backend), Set, UN, UN, UN, Release
+	l, err := v.Exclusive(ctx)
+	t.Nil(err)
+	t.Equal(v.SharedLock(), "42")
+	ctxTimeout, cancel := context.WithTimeout(ctx, testSecond/10)
+	defer cancel()
+	ver, err := v.SharedLockContext(ctxTimeout)
+	t.Nil(err)
+	t.Equal(ver, "42")
+	t.Equal(v.ExclusiveLock(), "42")
+	t.Nil(v.SetErr("43"))
+	v.Unlock()
+	v.Unlock()
+	v.Unlock()
+	t.DeepEqual(counters(), []int{0, 1, 0})
+	t.Nil(l.Release())
+	t.DeepEqual(counters(), []int{0, 1, 1})
+
+	// - Exclusive, WaitFor (locked), TrySH, TryEX (no backend), UN, UN, Release
+	reset()
+	l, err = v.Exclusive(ctx)
+	t.Nil(err)
+	_, err = v.WaitFor(ctx, func(schemaver.Version) bool { return true })
+	t.Err(err, schemaver.ErrLocked)
+	_, err = v.TrySharedLock()
+	t.Nil(err)
+	_, err = v.TryExclusiveLock()
+	t.Nil(err)
+	v.Unlock()
+	v.Unlock()
+	t.Nil(l.Release())
+	t.DeepEqual(counters(), []int{0, 1, 1})
+
+	// - Shared, SH (no backend), EX (under shared), UN, Release
+	reset()
+	l, err = v.Shared(ctx)
+	t.Nil(err)
+	t.Equal(v.SharedLock(), "42")
+	_, err = v.ExclusiveLockContext(ctx)
+	t.Err(err, schemaver.ErrUnderSharedLock)
+	v.Unlock()
+	t.DeepEqual(counters(), []int{1, 0, 0})
+	t.Nil(l.Release())
+	t.DeepEqual(counters(), []int{1, 0, 1})
+
+	// - Exclusive, SH in other goroutine (wait), Release, (SH), UN
+	reset()
+	l, err = v.Exclusive(ctx)
+	t.Nil(err)
+	done := make(chan struct{})
+	go func() { defer close(done); v.SharedLock(); v.Unlock() }()
+	select {
+	case <-done:
+		t.Fatal("not waiting")
+	case <-time.After(testSecond / 10):
+	}
+	t.Nil(l.Release())
+	<-done
+	t.DeepEqual(counters(), []int{1, 1, 2})
+}
+
+func TestLockHandlesConcurrent(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+
+	var (
+		wg        sync.WaitGroup
+		muHolders sync.Mutex
+		shared    int
+		exclusive int
+	)
+	verify := func() {
+		muHolders.Lock()
+		defer muHolders.Unlock()
+		t.True(exclusive == 0 || (exclusive == 1 && shared == 0), "shared=%d exclusive=%d", shared, exclusive)
+	}
+	hold := func(counter *int, delta int) {
+		muHolders.Lock()
+		*counter += delta
+		muHolders.Unlock()
+	}
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				counter, lock := &shared, v.Shared
+				if (i+j)%5 == 0 {
+					counter, lock = &exclusive, v.Exclusive
+				}
+				l, err := lock(context.Background())
+				t.Nil(err)
+				hold(counter, 1)
+				verify()
+				time.Sleep(time.Millisecond)
+				hold(counter, -1)
+				t.Nil(l.Release())
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	t.Equal(sh+ex, un)
+	mu.Unlock()
+}
+
+func TestUpgrade(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	ctx := context.Background()
+	counters := func() []int { mu.Lock(); defer mu.Unlock(); return []int{sh, ex, un} }
+
+	// - Upgrade (not locked), error
+	_, _, err = v.Upgrade(ctx)
+	t.Err(err, schemaver.ErrNotLocked)
+
+	// - SH, Upgrade (not changed), Set, UN
+	v.SharedLock()
+	ver, changed, err := v.Upgrade(ctx)
+	t.Nil(err)
+	t.Equal(ver, "42")
+	t.False(changed)
+	t.DeepEqual(counters(), []int{1, 1, 1})
+	t.Nil(v.SetErr("43"))
+	v.Unlock()
+	t.DeepEqual(counters(), []int{1, 1, 2})
+
+	// - SH, (changed), Upgrade (changed), Upgrade (under EX), UN
+	v.SharedLock()
+	setVer("44")
+	ver, changed, err = v.Upgrade(ctx)
+	t.Nil(err)
+	t.Equal(ver, "44")
+	t.True(changed)
+	ver, changed, err = v.Upgrade(ctx)
+	t.Nil(err)
+	t.Equal(ver, "44")
+	t.False(changed)
+	v.Unlock()
+	t.DeepEqual(counters(), []int{2, 2, 4})
+
+	// - Shared, SH in other goroutine, Upgrade (wait), Release, (Upgrade), UN
+	reset()
+	l, err := v.Shared(ctx)
+	t.Nil(err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.SharedLock()
+		_, _, err := v.Upgrade(ctx)
+		t.Nil(err)
+		v.Unlock()
+	}()
+	select {
+	case <-done:
+		t.Fatal("not waiting")
+	case <-time.After(testSecond / 10):
+	}
+	t.Nil(l.Release())
+	<-done
+	t.DeepEqual(counters(), []int{1, 1, 2})
+
+	// - SH, Upgrade in other goroutine (not locked), SH not changed, UN
+	reset()
+	v.SharedLock()
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, err := v.Upgrade(ctx)
+		t.Err(err, schemaver.ErrNotLocked)
+	}()
+	<-done
+	t.DeepEqual(counters(), []int{1, 0, 0})
+	t.Equal(v.Get(), "42")
+	t.Err(v.SetErr("43"), schemaver.ErrRequireExclusive)
+	v.Unlock()
+	t.DeepEqual(counters(), []int{1, 0, 1})
+
+	// - SH, Upgrade (failed, SH restored), UN
+	reset()
+	v.SharedLock()
+	block = make(chan struct{})
+	time.AfterFunc(testSecond/5, func() { close(block) })
+	ctxTimeout, cancel := context.WithTimeout(ctx, testSecond/10)
+	defer cancel()
+	_, _, err = v.Upgrade(ctxTimeout)
+	t.Err(err, context.DeadlineExceeded)
+	t.Equal(v.Get(), "42")
+	t.Err(v.SetErr("43"), schemaver.ErrRequireExclusive)
+	v.Unlock()
+	t.DeepEqual(counters(), []int{2, 1, 3})
+
+	// - SH, Upgrade (failed, SH can't be restored), error, UN (not locked)
+	reset()
+	v.SharedLock()
+	block = make(chan struct{})
+	mu.Lock()
+	lockPanic = true
+	mu.Unlock()
+	time.AfterFunc(testSecond/5, func() { close(block) })
+	ctxTimeout, cancel = context.WithTimeout(ctx, testSecond/10)
+	defer cancel()
+	_, _, err = v.Upgrade(ctxTimeout)
+	t.Err(err, schemaver.ErrLockLost)
+	t.Match(err, `deadline exceeded, lock lost: failed to re-acquire shared lock: .*mock panic`)
+	t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
+	t.DeepEqual(counters(), []int{1, 1, 2})
+}
+
+func TestDowngrade(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	ctx := context.Background()
+	counters := func() []int { mu.Lock(); defer mu.Unlock(); return []int{sh, ex, un, dn} }
+
+	// - Downgrade (not locked), SH, Downgrade, error
+	t.Err(v.Downgrade(), schemaver.ErrNotLocked)
+	v.SharedLock()
+	t.Err(v.Downgrade(), schemaver.ErrRequireExclusive)
+	v.Unlock()
+
+	// - EX, Shared (wait), Downgrade (atomic), (Shared), Release, UN
+	v.ExclusiveLock()
+	v.Set("43")
+	done := make(chan struct{})
+	go func() {
+		l, err := v.Shared(ctx)
+		t.Nil(err)
+		t.Equal(l.Version(), schemaver.Version("43"))
+		t.Nil(l.Release())
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("not waiting")
+	case <-time.After(testSecond / 10):
+	}
+	t.Nil(v.Downgrade())
+	<-done
+	t.Err(v.SetErr("44"), schemaver.ErrRequireExclusive)
+	t.Equal(v.Get(), "43")
+	v.Unlock()
+	t.DeepEqual(counters(), []int{1, 1, 2, 1})
+
+	// - EX, Downgrade (non-atomic), UN
+	reset()
+	os.Setenv(schemaver.EnvLocation, "test-basic://")
+	v, err = schemaver.New()
+	t.Nil(err)
+	v.ExclusiveLock()
+	t.Nil(v.Downgrade())
+	t.Equal(v.Get(), "42")
+	v.Unlock()
+	t.DeepEqual(counters(), []int{1, 1, 2, 0})
+
+	// - EnvSkipLock: EX, Downgrade, error
+	reset()
+	os.Setenv(schemaver.EnvSkipLock, "test://")
+	v, err = schemaver.New()
+	t.Nil(err)
+	v.ExclusiveLock()
+	t.Err(v.Downgrade(), schemaver.ErrNotSupported)
+	v.Unlock()
+}
+
 func TestUnlock(tt *testing.T) {
 	t := check.T(tt)
 	reset()
@@ -171,44 +849,247 @@ func TestGet(tt *testing.T) {
 	t := check.T(tt)
 	reset()
 
-	os.Setenv(schemaver.EnvLocation, "test://")
-	v, err := schemaver.New()
+	os.Setenv(schemaver.EnvLocation, "test://")
+	v, err := schemaver.New()
+	t.Nil(err)
+
+	// - Get() (lockType==unlocked), panic
+	t.PanicMatch(func() { v.Get() }, `require SharedLock or ExclusiveLock`)
+
+	// - Get() (lockType==shared), success
+	v.SharedLock()
+	t.Equal(v.Get(), "42")
+	v.Unlock()
+
+	// - Get() (lockType==exclusive), success
+	v.ExclusiveLock()
+	t.Equal(v.Get(), "42")
+	v.Unlock()
+}
+
+func TestSet(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	os.Setenv(schemaver.EnvLocation, "test://")
+	v, err := schemaver.New()
+	t.Nil(err)
+
+	// - Set() (lockType==unlocked), panic
+	t.PanicMatch(func() { v.Set("13") }, `require ExclusiveLock`)
+
+	// - Set() (lockType==shared), panic
+	v.SharedLock()
+	t.PanicMatch(func() { v.Set("13") }, `require ExclusiveLock`)
+	v.Unlock()
+
+	// - Set() (lockType==exclusive), success
+	v.ExclusiveLock()
+	v.Set("13")
+	t.Equal(v.Get(), "13")
+
+	// - Set() (invalid version), panic
+	t.PanicMatch(func() { v.Set("13.") }, `invalid version value`)
+	t.Err(v.SetErr("v13"), schemaver.ErrInvalidVersion)
+	t.Equal(v.Get(), "13")
+	v.Unlock()
+}
+
+func TestSetIf(tt *testing.T) {
+	t := check.T(tt)
+
+	for _, loc := range []string{"test://", "test-basic://"} {
+		loc := loc
+		t.Run(loc, func(tt *testing.T) {
+			t := check.T(tt)
+			reset()
+
+			v, err := schemaver.NewAt(loc)
+			t.Nil(err)
+			defer v.Close()
+
+			// - SetIf (lockType==unlocked/shared), error
+			t.Err(v.SetIf("42", "43"), schemaver.ErrRequireExclusive)
+			v.SharedLock()
+			t.Err(v.SetIf("42", "43"), schemaver.ErrRequireExclusive)
+			v.Unlock()
+
+			v.ExclusiveLock()
+			defer v.Unlock()
+
+			// - SetIf (invalid version), error
+			t.Err(v.SetIf("42", "v43"), schemaver.ErrInvalidVersion)
+
+			// - SetIf (expected version), success
+			t.Nil(v.SetIf("42", "43"))
+			t.Equal(v.Get(), "43")
+
+			// - SetIf (other version), conflict with actual version
+			err = v.SetIf("42", "44")
+			t.True(errors.Is(err, schemaver.ErrVersionConflict))
+			var conflictErr *schemaver.VersionConflictError
+			t.True(errors.As(err, &conflictErr))
+			t.DeepEqual(conflictErr, &schemaver.VersionConflictError{Expected: "42", Actual: "43"})
+			t.Match(err, `version conflict: expected "42", actual "43"`)
+			t.Equal(v.Get(), "43")
+
+			// - SetIf (backend panics), error
+			t.Err(v.SetIf("43", "666"), errMockPanic)
+			t.Equal(v.Get(), "43")
+		})
+	}
+}
+
+func TestMigrate(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+	logger := make(testLogger, 2)
+	getVer := func() string { mu.Lock(); defer mu.Unlock(); return ver }
+
+	v, err := schemaver.New(schemaver.WithLogger(logger))
+	t.Nil(err)
+	defer v.Close()
+	ctx := context.Background()
+	calls := 0
+
+	// - invalid version, error
+	t.Err(v.Migrate(ctx, "42", "v43", nil), schemaver.ErrInvalidVersion)
+
+	// - success, fn called with dirty version, version set, lock released
+	err = v.Migrate(ctx, "42", "43", func(context.Context) error {
+		calls++
+		t.Equal(getVer(), schemaver.BadVersion)
+		return nil
+	})
+	t.Nil(err)
+	t.Equal(calls, 1)
+	t.Equal(getVer(), "43")
+	t.Match(<-logger, `migrating from "42" to "43", version set to "dirty"`)
+	t.Equal(v.ExclusiveLock(), "43")
+	t.Equal(must(v.Note()), `migrating from "42" to "43"`)
+	v.Unlock()
+
+	// - Note (not locked, not supported), error
+	_, err = v.Note()
+	t.Err(err, schemaver.ErrNotLocked)
+	vBasic, err := schemaver.NewAt("test-basic://")
+	t.Nil(err)
+	defer vBasic.Close()
+	vBasic.SharedLock()
+	_, err = vBasic.Note()
+	t.Err(err, schemaver.ErrNotSupported)
+	vBasic.Unlock()
+
+	// - other version, conflict, fn not called
+	err = v.Migrate(ctx, "42", "44", func(context.Context) error { calls++; return nil })
+	t.DeepEqual(err, &schemaver.VersionConflictError{Expected: "42", Actual: "43"})
+	t.Equal(calls, 1)
+	t.Equal(getVer(), "43")
+
+	// - fn error, version left dirty
+	err = v.Migrate(ctx, "43", "44", func(context.Context) error { return errInvalid })
+	var migrateErr *schemaver.MigrateError
+	t.True(errors.As(err, &migrateErr))
+	t.Equal(migrateErr.From, schemaver.Version("43"))
+	t.Equal(migrateErr.To, schemaver.Version("44"))
+	t.True(errors.Is(err, errInvalid))
+	t.Match(err, `migration from "43" to "44" failed, version left "dirty": `+errInvalid.Error())
+	t.Equal(getVer(), schemaver.BadVersion)
+	<-logger
+	t.Match(<-logger, `migration from "43" to "44" failed`)
+
+	// - fn panics, version left dirty
+	err = v.Migrate(ctx, schemaver.BadVersion, "44", func(context.Context) error { panic(errMockPanic) })
+	t.True(errors.As(err, &migrateErr))
+	t.Equal(migrateErr.Panic, errMockPanic)
+	t.NotZero(migrateErr.Stack)
+	t.True(errors.Is(err, errMockPanic))
+	t.Match(err, `failed, version left "dirty": panic: mock panic`)
+	t.Equal(getVer(), schemaver.BadVersion)
+	t.Equal(v.ExclusiveLock(), schemaver.BadVersion)
+	v.Unlock()
+
+	// - Lock.Migrate (shared), error
+	lock, err := v.Shared(ctx)
+	t.Nil(err)
+	t.Err(lock.Migrate(ctx, schemaver.BadVersion, "44", nil), schemaver.ErrRequireExclusive)
+	t.Nil(lock.Release())
+
+	// - Lock.Migrate (exclusive) twice, lock kept
+	lock, err = v.Exclusive(ctx)
 	t.Nil(err)
+	noop := func(context.Context) error { return nil }
+	t.Nil(lock.Migrate(ctx, schemaver.BadVersion, "44", noop))
+	t.Nil(lock.Migrate(ctx, "44", "45", noop))
+	t.Equal(v.Get(), "45")
+	t.Nil(lock.Release())
 
-	// - Get() (lockType==unlocked), panic
-	t.PanicMatch(func() { v.Get() }, `require SharedLock or ExclusiveLock`)
+	// - Lock.Migrate (released), error
+	t.Err(lock.Migrate(ctx, "45", "46", noop), schemaver.ErrReleased)
+	t.Equal(getVer(), "45")
 
-	// - Get() (lockType==shared), success
-	v.SharedLock()
-	t.Equal(v.Get(), "42")
-	v.Unlock()
+	// - no Logger, standard logger not used, error saved as note
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	v2, err := schemaver.New()
+	t.Nil(err)
+	defer v2.Close()
+	t.NotNil(v2.Migrate(ctx, "45", "46", func(context.Context) error { return errInvalid }))
+	t.Zero(buf.String())
+	t.Equal(v2.SharedLock(), schemaver.BadVersion)
+	t.Match(must(v2.Note()), `migration from "45" to "46" failed, version left "dirty": `+errInvalid.Error())
+	v2.Unlock()
 
-	// - Get() (lockType==exclusive), success
-	v.ExclusiveLock()
-	t.Equal(v.Get(), "42")
-	v.Unlock()
+	// - no Logger, running migration saved as note (in case it'll be interrupted)
+	err = v2.Migrate(ctx, schemaver.BadVersion, "47", func(context.Context) error {
+		t.Equal(must(v2.Note()), `migrating from "dirty" to "47"`)
+		return nil
+	})
+	t.Nil(err)
 }
 
-func TestSet(tt *testing.T) {
+func must(s string, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestErr(tt *testing.T) {
 	t := check.T(tt)
 	reset()
 
-	os.Setenv(schemaver.EnvLocation, "test://")
 	v, err := schemaver.New()
 	t.Nil(err)
+	ctx := context.Background()
 
-	// - Set() (lockType==unlocked), panic
-	t.PanicMatch(func() { v.Set("13") }, `require ExclusiveLock`)
+	// - UN/Get/Set (lockType==unlocked), error
+	t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
+	_, err = v.GetErr()
+	t.Err(err, schemaver.ErrNotLocked)
+	t.Err(v.SetErr("13"), schemaver.ErrRequireExclusive)
 
-	// - Set() (lockType==shared), panic
-	v.SharedLock()
-	t.PanicMatch(func() { v.Set("13") }, `require ExclusiveLock`)
-	v.Unlock()
+	// - SH, Set, EX (lockType==shared), error
+	_, err = v.SharedLockContext(ctx)
+	t.Nil(err)
+	t.Err(v.SetErr("13"), schemaver.ErrRequireExclusive)
+	_, err = v.ExclusiveLockContext(ctx)
+	t.Err(err, schemaver.ErrUnderSharedLock)
+	t.Nil(v.UnlockErr())
 
-	// - Set() (lockType==exclusive), success
-	v.ExclusiveLock()
-	v.Set("13")
-	v.Unlock()
+	// - EX, Set (backend panics), error, Get, UN
+	_, err = v.ExclusiveLockContext(ctx)
+	t.Nil(err)
+	err = v.SetErr("666")
+	t.Err(err, errMockPanic)
+	t.True(errors.Is(err, schemaver.ErrPanic))
+	t.Match(err, `backend panic: mock panic`)
+	ver, err := v.GetErr()
+	t.Nil(err)
+	t.Equal(ver, "42")
+	t.Nil(v.UnlockErr())
+	t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
 }
 
 func TestRecursiveLocks(tt *testing.T) {
@@ -258,6 +1139,62 @@ func TestRecursiveLocks(tt *testing.T) {
 	// - SH, EX - panic
 	v.SharedLock()
 	t.PanicMatch(func() { v.ExclusiveLock() }, `unable to acquire exclusive lock under shared lock`)
+	v.Unlock()
+}
+
+func TestRecursiveLocksConcurrent(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	defer v.Close()
+	ctx := context.Background()
+	counters := func() []int { mu.Lock(); defer mu.Unlock(); return []int{sh, ex, un} }
+	done := func(c <-chan error) bool {
+		select {
+		case err := <-c:
+			t.Nil(err)
+			return true
+		case <-time.After(testSecond / 10):
+			return false
+		}
+	}
+	goLock := func(f func() error) <-chan error {
+		c := make(chan error, 1)
+		go func() { c <- f() }()
+		return c
+	}
+
+	// - SH, EX in other goroutine (wait), SH (recursive), SH in other goroutine (wait)
+	v.SharedLock()
+	exc := goLock(func() error {
+		_, err := v.ExclusiveLockContext(ctx)
+		return err
+	})
+	t.False(done(exc))
+	t.Equal(v.SharedLock(), "42")
+	shc := goLock(func() error {
+		_, err := v.SharedLockContext(ctx)
+		return err
+	})
+	t.False(done(shc))
+	ctxTimeout, cancel := context.WithTimeout(ctx, testSecond/10)
+	defer cancel()
+	_, err = v.Shared(ctxTimeout)
+	t.Err(err, context.DeadlineExceeded)
+
+	// - UN, UN, (EX), UN, (SH), UN
+	v.Unlock()
+	t.False(done(exc))
+	v.Unlock()
+	t.True(done(exc))
+	t.False(done(shc))
+	t.DeepEqual(counters(), []int{1, 1, 1})
+	v.Unlock()
+	t.True(done(shc))
+	v.Unlock()
+	t.DeepEqual(counters(), []int{2, 1, 3})
 }
 
 func TestHoldSharedLock(tt *testing.T) {
@@ -305,6 +1242,261 @@ func TestHoldSharedLock2(tt *testing.T) {
 	t.Nil(v.Close())
 }
 
+func TestHoldSharedLockYield(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	counters := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return []int{sh, ex, un}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := v.HoldSharedLockYield(ctx, testSecond*10, testSecond/20)
+	time.Sleep(testSecond / 10)
+	t.DeepEqual(counters(), []int{1, 0, 0})
+
+	// - Exclusive in other goroutine - yield immediately
+	start := time.Now()
+	l, err := v.Exclusive(ctx)
+	t.Nil(err)
+	t.Less(int64(time.Since(start)), int64(testSecond/2))
+	t.DeepEqual(counters(), []int{1, 1, 1})
+	l.Release()
+	time.Sleep(testSecond / 10)
+	t.DeepEqual(counters(), []int{2, 1, 2})
+
+	// - Exclusive waits for SharedLock in this goroutine - do not spin
+	v.SharedLock()
+	acquired := make(chan *schemaver.Lock)
+	go func() {
+		l, _ := v.Exclusive(ctx)
+		acquired <- l
+	}()
+	time.Sleep(testSecond / 10)
+	relocks := h.Stats().Relocks
+	time.Sleep(testSecond / 5)
+	t.Equal(h.Stats().Relocks, relocks)
+	v.Unlock()
+	l = <-acquired
+	t.NotNil(l)
+	t.DeepEqual(counters(), []int{2, 2, 3})
+	l.Release()
+	time.Sleep(testSecond / 10)
+	t.DeepEqual(counters(), []int{3, 2, 4})
+
+	// - Exclusive in other process - yield after check
+	mu.Lock()
+	pending = true
+	mu.Unlock()
+	time.Sleep(testSecond / 10)
+	mu.Lock()
+	pending = false
+	t.GreaterOrEqual(un, 3)
+	mu.Unlock()
+	time.Sleep(testSecond / 10)
+	c := counters()
+	t.Equal(c[0]+c[1], c[2]+1)
+
+	cancel()
+	t.Nil(v.Close())
+	c = counters()
+	t.Equal(c[0]+c[1], c[2])
+
+	// - protocol without ManagePending - works like HoldSharedLock
+	reset()
+	v, err = schemaver.NewAt("test-basic://")
+	t.Nil(err)
+	pending = true
+	v.HoldSharedLockYield(context.Background(), testSecond*10, testSecond/20)
+	time.Sleep(testSecond / 5)
+	t.DeepEqual(counters(), []int{1, 0, 0})
+	t.Nil(v.Close())
+}
+
+func TestHolder(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	o := newHeldObserver()
+	v.SetObserver(o)
+	isHeld := func() bool { held, _ := o.state(); return held }
+
+	h1 := v.HoldSharedLock(context.Background(), testSecond/10)
+	t.True(o.waitAcquired(4))
+	h1.Pause()
+	t.False(isHeld())
+	_, acquired := o.state()
+	stats := h1.Stats()
+	t.Equal(stats.Relocks, acquired-1)
+	t.Greater(int64(stats.HoldTime), int64(testSecond/4))
+	t.Less(int64(stats.WaitTime), int64(testSecond/10))
+
+	// - Pause, Resume
+	h1.Pause()
+	time.Sleep(testSecond / 5)
+	t.False(isHeld())
+	t.Equal(h1.Stats().Relocks, stats.Relocks)
+	h1.Resume()
+	h1.Resume()
+	t.True(o.waitHeld())
+
+	// - independent holders
+	h2 := v.HoldSharedLock(context.Background(), testSecond/10)
+	h1.Stop()
+	h1.Stop()
+	_, ok := <-h1.Err()
+	t.False(ok)
+	t.True(o.waitHeld())
+	h2.Stop()
+	t.False(isHeld())
+
+	// - errors
+	mu.Lock()
+	lockPanic = true
+	mu.Unlock()
+	h3 := v.HoldSharedLock(context.Background(), testSecond/10)
+	t.Match(<-h3.Err(), `backend panic: mock panic`)
+	mu.Lock()
+	lockPanic = false
+	mu.Unlock()
+	t.True(o.waitHeld())
+	t.Nil(v.Close())
+	t.False(isHeld())
+	mu.Lock()
+	t.Equal(sh, un)
+	mu.Unlock()
+	_, ok = <-h3.Err()
+	t.False(ok)
+}
+
+func TestLockLost(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+	errNetwork := errors.New("network error")
+	setErrPing := func(err error) { mu.Lock(); errPing = err; mu.Unlock() }
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	defer v.Close()
+	v2, err := schemaver.NewAt("test-basic://")
+	t.Nil(err)
+	defer v2.Close()
+
+	// - unlocked - no check
+	// - protocol without ManagePing - no check
+	setErrPing(errNetwork)
+	v2.SharedLock()
+	time.Sleep(testSecond * 3 / 2)
+	t.Len(v.LockLost(), 0)
+	t.Len(v2.LockLost(), 0)
+	v2.Unlock()
+
+	// - locked - lock lost
+	v.SharedLock()
+	select {
+	case err = <-v.LockLost():
+		t.Match(err, `network error`)
+		t.True(errors.Is(err, schemaver.ErrLockLost))
+	case <-time.After(testSecond * 3 / 2):
+		t.Fail()
+	}
+	v.Unlock()
+
+	// - locked - lock is fine
+	setErrPing(nil)
+	v.ExclusiveLock()
+	time.Sleep(testSecond * 3 / 2)
+	t.Len(v.LockLost(), 0)
+	v.Unlock()
+
+	// - lock lost (unread), UN, locked - error about previous lock dropped
+	setErrPing(errNetwork)
+	v.SharedLock()
+	time.Sleep(testSecond * 3 / 2)
+	t.Len(v.LockLost(), 1)
+	v.Unlock()
+	setErrPing(nil)
+	v.SharedLock()
+	t.Len(v.LockLost(), 0)
+	v.Unlock()
+}
+
+type testLogger chan string
+
+func (l testLogger) Printf(format string, v ...interface{}) {
+	select {
+	case l <- fmt.Sprintf(format, v...):
+	default:
+	}
+}
+
+func TestOptions(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+	logger := make(testLogger, 1)
+
+	v, err := schemaver.NewAt("test-options://",
+		schemaver.WithLockTimeout(testSecond/10),
+		schemaver.WithDialTimeout(testSecond),
+		schemaver.WithReadWriteTimeout(2*testSecond),
+		schemaver.WithPingInterval(testSecond/10),
+		schemaver.WithLogger(logger),
+	)
+	t.Nil(err)
+	defer v.Close()
+
+	// - options passed to protocol
+	mu.Lock()
+	t.Equal(gotOpts.LockTimeout, testSecond/10)
+	t.Equal(gotOpts.DialTimeout, testSecond)
+	t.Equal(gotOpts.ReadWriteTimeout, 2*testSecond)
+	t.Equal(gotOpts.PingInterval, testSecond/10)
+	t.NotNil(gotOpts.NewBackOff())
+	mu.Unlock()
+
+	// - defaults
+	_, err = schemaver.NewAt("test-options://")
+	t.Nil(err)
+	mu.Lock()
+	t.Zero(gotOpts.LockTimeout)
+	t.Equal(gotOpts.PingInterval, time.Second)
+	t.NotNil(gotOpts.NewBackOff())
+	gotOpts.Logf("no logger") // Must not panic.
+	mu.Unlock()
+
+	// - invalid
+	_, err = schemaver.NewAt("test-options://", schemaver.WithPingInterval(-time.Second))
+	t.Err(err, schemaver.ErrInvalidOption)
+
+	// - SH (blocked), error after LockTimeout
+	block = make(chan struct{})
+	start := time.Now()
+	_, err = v.SharedLockContext(context.Background())
+	t.Err(err, context.DeadlineExceeded)
+	t.Less(time.Since(start), testSecond/2)
+	close(block)
+
+	// - SH, lock lost is logged after PingInterval
+	mu.Lock()
+	errPing = errors.New("network error")
+	mu.Unlock()
+	v.SharedLock()
+	select {
+	case msg := <-logger:
+		t.Match(msg, `lock lost: network error`)
+	case <-time.After(testSecond / 2):
+		t.Fail()
+	}
+	v.Unlock()
+}
+
 func TestAddCallback(tt *testing.T) {
 	t := check.T(tt)
 	reset()
@@ -381,19 +1573,197 @@ func TestAddCallback(tt *testing.T) {
 	t.Equal(un, 2)
 }
 
+func TestRequire(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+
+	// - invalid constraint, error
+	t.Err(v.Require(">=x", schemaver.PolicyFail), schemaver.ErrInvalidConstraint)
+
+	// - PolicyFail: SH/EX (unsupported), error, (backend lock released)
+	t.Nil(v.Require(">=3 <42", schemaver.PolicyFail))
+	_, err = v.SharedLockContext(context.Background())
+	t.True(errors.Is(err, schemaver.ErrUnsupportedVersion))
+	t.Match(err, `unsupported version "42", require ">=3 <42"`)
+	_, err = v.ExclusiveLockContext(context.Background())
+	t.True(errors.Is(err, schemaver.ErrUnsupportedVersion))
+	t.DeepEqual([]int{sh, ex, un}, []int{1, 1, 2})
+	t.PanicMatch(func() { v.SharedLock() }, `unsupported version`)
+	t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
+
+	// - PolicyFail: EX (supported), SH (recursive, unsupported), error, UN
+	t.Nil(v.Require("42", schemaver.PolicyFail))
+	t.Equal(v.ExclusiveLock(), "42")
+	t.Nil(v.Require("!=42", schemaver.PolicyFail))
+	_, err = v.SharedLockContext(context.Background())
+	t.True(errors.Is(err, schemaver.ErrUnsupportedVersion))
+	v.Unlock()
+	t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
+
+	// - PolicyReport: SH (unsupported), error, lock is held, UN
+	reset()
+	t.Nil(v.Require("1.2.x", schemaver.PolicyReport))
+	calls := 0
+	v.AddCallback(func(string) { calls++ })
+	cur, err := v.SharedLockContext(context.Background())
+	t.True(errors.Is(err, schemaver.ErrUnsupportedVersion))
+	var errUnsupported *schemaver.UnsupportedVersionError
+	t.True(errors.As(err, &errUnsupported))
+	t.True(errUnsupported.LockHeld)
+	t.Equal(errUnsupported.Version, schemaver.Version("42"))
+	t.Equal(errUnsupported.Constraint.String(), "1.2.x")
+	t.Equal(cur, "42")
+	t.Equal(calls, 1)
+	v.Unlock()
+	t.Equal(v.ExclusiveLock(), "42")
+	v.Unlock()
+	t.DeepEqual([]int{sh, ex, un, calls}, []int{1, 1, 2, 2})
+
+	// - PolicyWait: SH (unsupported until ctx.Done), error
+	reset()
+	t.Nil(v.Require("!=42", schemaver.PolicyWait))
+	ctx, cancel := context.WithTimeout(context.Background(), testSecond/10)
+	defer cancel()
+	_, err = v.SharedLockContext(ctx)
+	t.Err(err, context.DeadlineExceeded)
+	t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
+
+	// - PolicyWait: EX (unsupported until version changed), UN
+	reset()
+	ver = schemaver.NoVersion
+	time.AfterFunc(testSecond/10, func() { mu.Lock(); ver = "3"; mu.Unlock() })
+	t.Nil(v.Require("!none", schemaver.PolicyWait))
+	t.Equal(v.ExclusiveLock(), "3")
+	v.Unlock()
+	mu.Lock()
+	t.Greater(ex, 1)
+	t.Equal(un, ex)
+	mu.Unlock()
+}
+
+func TestWaitFor(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	isNumbered := func(ver schemaver.Version) bool { return !ver.IsNone() && !ver.IsDirty() }
+
+	// - version supported, SH UN
+	ver, err := v.WaitFor(context.Background(), isNumbered)
+	t.Nil(err)
+	t.Equal(ver, schemaver.Version("42"))
+	t.DeepEqual([]int{sh, ex, un}, []int{1, 0, 1})
+
+	// - under lock, error
+	v.SharedLock()
+	_, err = v.WaitFor(context.Background(), isNumbered)
+	t.Err(err, schemaver.ErrLocked)
+	v.Unlock()
+
+	// - version unsupported until ctx.Done, error
+	reset()
+	setVer(schemaver.BadVersion)
+	ctx, cancel := context.WithTimeout(context.Background(), testSecond/10)
+	defer cancel()
+	ver, err = v.WaitFor(ctx, isNumbered)
+	t.Err(err, context.DeadlineExceeded)
+	t.Equal(ver, schemaver.Version(schemaver.BadVersion))
+	mu.Lock()
+	t.Equal(un, sh)
+	mu.Unlock()
+
+	// - version unsupported until changed, ignore Require
+	reset()
+	setVer(schemaver.NoVersion)
+	c, err := schemaver.ParseConstraint(">=3")
+	t.Nil(err)
+	for _, policy := range []schemaver.Policy{schemaver.PolicyFail, schemaver.PolicyReport} {
+		t.Nil(v.Require("none", policy))
+		time.AfterFunc(testSecond/10, func() { setVer("3") })
+		ver, err = v.WaitFor(context.Background(), c.Check)
+		t.Nil(err)
+		t.Equal(ver, schemaver.Version("3"))
+		t.Err(v.UnlockErr(), schemaver.ErrNotLocked)
+		setVer(schemaver.NoVersion)
+	}
+}
+
+func TestWatch(tt *testing.T) {
+	t := check.T(tt)
+	reset()
+
+	v, err := schemaver.New()
+	t.Nil(err)
+	recv := func(c <-chan schemaver.Version) (ver schemaver.Version) {
+		select {
+		case ver = <-c:
+		case <-time.After(3 * testSecond):
+			t.Fatal("timeout")
+		}
+		return ver
+	}
+
+	// - native notifications: current, changed, ctx.Done
+	changed = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	c := v.Watch(ctx)
+	t.Equal(recv(c), schemaver.Version("42"))
+	setVer("43")
+	changed <- struct{}{}
+	t.Equal(recv(c), schemaver.Version("43"))
+	cancel()
+	t.Zero(recv(c))
+
+	// - polling: current, changed, Close
+	reset()
+	c = v.Watch(context.Background())
+	t.Equal(recv(c), schemaver.Version("42"))
+	setVer("43")
+	t.Equal(recv(c), schemaver.Version("43"))
+	t.Nil(v.Close())
+	t.Zero(recv(c))
+	mu.Lock()
+	t.Equal(un, sh)
+	mu.Unlock()
+}
+
 var (
 	errBadLocation = errors.New("location must not contain host")
 	errInitialized = errors.New("version already initialized")
 	errInvalid     = errors.New("version is invalid")
+	errMockPanic   = errors.New("mock panic")
 	mu             sync.Mutex
-	sh, ex, un     int
+	sh, ex, un, dn int
 	ver            string
+	block          chan struct{}
+	changed        chan struct{}
+	pending        bool
+	lockPanic      bool
+	errPing        error
+	gotOpts        schemaver.Options
+	token          string
+	note           string
 )
 
+func setVer(v string) { mu.Lock(); ver = v; mu.Unlock() }
+
 func reset() {
+	mu.Lock()
+	defer mu.Unlock()
 	os.Unsetenv(schemaver.EnvSkipLock)
 	os.Setenv(schemaver.EnvLocation, "test://")
-	ver, sh, ex, un = "42", 0, 0, 0
+	ver, sh, ex, un, dn = "42", 0, 0, 0, 0
+	block = nil
+	changed = nil
+	pending = false
+	lockPanic = false
+	errPing = nil
+	token = ""
+	note = ""
 }
 
 func mockInitialize(loc *url.URL) error {
@@ -418,9 +1788,120 @@ func mockNew(loc *url.URL) (schemaver.Manage, error) {
 
 type mockManage struct{}
 
-func (m *mockManage) SharedLock()    { mu.Lock(); sh++; mu.Unlock() }
-func (m *mockManage) ExclusiveLock() { mu.Lock(); ex++; mu.Unlock() }
+// mockManageBasic implements only Manage.
+type mockManageBasic struct{ schemaver.Manage }
+
+func wait() {
+	if block != nil {
+		<-block
+	}
+}
+
+func (m *mockManage) ExclusiveLock() { wait(); mu.Lock(); ex++; mu.Unlock() }
 func (m *mockManage) Unlock()        { mu.Lock(); un++; mu.Unlock() }
-func (m *mockManage) Get() string    { return ver }
-func (m *mockManage) Set(v string)   { ver = v }
+func (m *mockManage) Get() string    { mu.Lock(); defer mu.Unlock(); return ver }
 func (m *mockManage) Close() error   { return nil }
+
+func (m *mockManage) SharedLock() {
+	wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if lockPanic {
+		panic(errMockPanic)
+	}
+	sh++
+}
+
+func (m *mockManage) TrySharedLock() error    { return try(&sh) }
+func (m *mockManage) TryExclusiveLock() error { return try(&ex) }
+
+func (m *mockManage) Watch(ctx context.Context) (<-chan struct{}, error) {
+	changed := changed
+	if changed == nil {
+		return nil, schemaver.ErrNotSupported
+	}
+	c := make(chan struct{}, 1)
+	go func() {
+		defer close(c)
+		for {
+			select {
+			case <-changed:
+				c <- struct{}{}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (m *mockManage) Downgrade() error { mu.Lock(); dn++; mu.Unlock(); return nil }
+
+func (m *mockManage) Ping(context.Context) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return errPing
+}
+
+// mockManageToken implements ManageToken, valid token is "tokenN"
+// where N is amount of ExclusiveLock.
+type mockManageToken struct{ *mockManage }
+
+func (m mockManageToken) Unlock() { mu.Lock(); token = ""; mu.Unlock(); m.mockManage.Unlock() }
+
+func (m mockManageToken) Token() (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	token = fmt.Sprintf("token%d", ex)
+	return token, nil
+}
+
+func (m mockManageToken) VerifyToken(t string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if token == "" || t != token {
+		return schemaver.ErrInvalidToken
+	}
+	return nil
+}
+
+func (m *mockManage) ExclusivePending() (bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return pending, nil
+}
+
+func try(counter *int) error {
+	if block != nil {
+		select {
+		case <-block:
+		default:
+			return schemaver.ErrWouldBlock
+		}
+	}
+	mu.Lock()
+	*counter++
+	mu.Unlock()
+	return nil
+}
+
+func (m *mockManage) SetIf(expected, v string) error {
+	mu.Lock()
+	actual := ver
+	mu.Unlock()
+	if actual != expected {
+		return &schemaver.VersionConflictError{Expected: schemaver.Version(expected), Actual: schemaver.Version(actual)}
+	}
+	m.Set(v)
+	return nil
+}
+
+func (m *mockManage) Note() (string, error)  { mu.Lock(); defer mu.Unlock(); return note, nil }
+func (m *mockManage) SetNote(n string) error { mu.Lock(); note = n; mu.Unlock(); return nil }
+
+func (m *mockManage) Set(v string) {
+	if v == "666" {
+		panic(errMockPanic)
+	}
+	ver = v
+}
@@ -0,0 +1,88 @@
+package schemaver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Version of data schema: either NoVersion or BadVersion or one or more
+// digits separated with single dots (for ex. "42", "0", "0.12.0").
+//
+// Use ParseVersion to get valid Version from a string.
+type Version string
+
+// ParseVersion returns Version or error if s is not a valid version.
+func ParseVersion(s string) (Version, error) {
+	if s == NoVersion || s == BadVersion {
+		return Version(s), nil
+	}
+	for _, part := range strings.Split(s, ".") {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidVersion, s)
+		}
+	}
+	return Version(s), nil
+}
+
+// IsNone returns true if version is NoVersion.
+func (v Version) IsNone() bool { return v == NoVersion }
+
+// IsDirty returns true if version is BadVersion.
+func (v Version) IsDirty() bool { return v == BadVersion }
+
+// String returns version as a string.
+func (v Version) String() string { return string(v) }
+
+// Compare returns -1, 0 or +1 if v is less than, equal to or greater
+// than other.
+//
+// Numbered versions are compared component-wise, each component is
+// compared as a number (so "0.9" < "0.12.0" and "1.2" < "1.2.0").
+// NoVersion is less than BadVersion, and both are less than any
+// numbered version.
+func (v Version) Compare(other Version) int {
+	if r1, r2 := v.rank(), other.rank(); r1 != r2 {
+		return sign(r1 - r2)
+	} else if r1 != rankNumbered {
+		return 0
+	}
+
+	parts1, parts2 := strings.Split(string(v), "."), strings.Split(string(other), ".")
+	for i := 0; i < len(parts1) && i < len(parts2); i++ {
+		n1, n2 := strings.TrimLeft(parts1[i], "0"), strings.TrimLeft(parts2[i], "0")
+		if len(n1) != len(n2) {
+			return sign(len(n1) - len(n2))
+		} else if c := strings.Compare(n1, n2); c != 0 {
+			return c
+		}
+	}
+	return sign(len(parts1) - len(parts2))
+}
+
+const (
+	rankNone = iota
+	rankDirty
+	rankNumbered
+)
+
+func (v Version) rank() int {
+	switch {
+	case v.IsNone():
+		return rankNone
+	case v.IsDirty():
+		return rankDirty
+	default:
+		return rankNumbered
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,87 @@
+package schemaver_test
+
+import (
+	"testing"
+
+	"github.com/powerman/check"
+
+	"github.com/powerman/narada4d/schemaver"
+)
+
+func TestParseVersion(tt *testing.T) {
+	t := check.T(tt)
+
+	cases := []struct {
+		s       string
+		wantErr bool
+	}{
+		{"none", false},
+		{"dirty", false},
+		{"0", false},
+		{"42", false},
+		{"0.12.0", false},
+		{"007", false},
+		{"", true},
+		{" ", true},
+		{"None", true},
+		{"rat", true},
+		{"42.", true},
+		{".42", true},
+		{"42..1", true},
+		{"-42", true},
+		{"v1.2.3", true},
+		{"1.2.x", true},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.s, func(tt *testing.T) {
+			t := check.T(tt)
+			ver, err := schemaver.ParseVersion(tc.s)
+			if tc.wantErr {
+				t.Err(err, schemaver.ErrInvalidVersion)
+				t.Zero(ver)
+			} else {
+				t.Nil(err)
+				t.Equal(ver.String(), tc.s)
+			}
+		})
+	}
+}
+
+func TestVersion(tt *testing.T) {
+	t := check.T(tt)
+
+	t.True(schemaver.Version("none").IsNone())
+	t.False(schemaver.Version("none").IsDirty())
+	t.True(schemaver.Version("dirty").IsDirty())
+	t.False(schemaver.Version("dirty").IsNone())
+	t.False(schemaver.Version("0").IsNone())
+	t.False(schemaver.Version("0").IsDirty())
+}
+
+func TestVersionCompare(tt *testing.T) {
+	t := check.T(tt)
+
+	cases := []struct {
+		v1, v2 schemaver.Version
+		want   int
+	}{
+		{"none", "none", 0},
+		{"dirty", "dirty", 0},
+		{"none", "dirty", -1},
+		{"none", "0", -1},
+		{"dirty", "0", -1},
+		{"42", "42", 0},
+		{"42", "042", 0},
+		{"9", "10", -1},
+		{"0.9", "0.12.0", -1},
+		{"1.2", "1.2.0", -1},
+		{"1.10", "1.9.9", 1},
+		{"2", "1.9.9", 1},
+		{"123456789012345678901234567890", "123456789012345678901234567891", -1},
+	}
+	for _, tc := range cases {
+		t.Equal(tc.v1.Compare(tc.v2), tc.want, "%s <=> %s", tc.v1, tc.v2)
+		t.Equal(tc.v2.Compare(tc.v1), -tc.want, "%s <=> %s", tc.v2, tc.v1)
+	}
+}